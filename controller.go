@@ -4,24 +4,53 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"maps"
+	"math/rand"
+	"net"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 var _ csi.IdentityServer = (*ControllerCsi)(nil)
 var _ csi.ControllerServer = (*ControllerCsi)(nil)
 
+const (
+	// how volumes are created from a snapshot
+	//   clone   - zfs clone, the new dataset depends on the snapshot
+	//   promote - zfs clone followed by zfs promote, the snapshot's dataset becomes the dependent one
+	//   copy    - zfs send | zfs recv, full independent copy of the data
+	PARAMETER_SNAPSHOT_RESTORE_MODE = "snapshotRestoreMode"
+
+	SNAPSHOT_RESTORE_MODE_CLONE   = "clone"
+	SNAPSHOT_RESTORE_MODE_PROMOTE = "promote"
+	SNAPSHOT_RESTORE_MODE_COPY    = "copy"
+)
+
 type ControllerConfig struct {
-	ParentDataset string
+	// node id to address of nodes that can't be resolved using dns
+	NfsNodeAddresses map[string]string
 }
 
 type ControllerCsi struct {
 	config *ControllerConfig
-	client *ZfsClient
+	hosts  StorageHosts
+
+	publishLock sync.Mutex
+
+	// index of the next parent dataset of the round robin policy, per list of candidates
+	roundRobinLock sync.Mutex
+	roundRobinNext map[string]int
 }
 
 // GetPluginCapabilities implements csi.IdentityServer.
@@ -53,7 +82,7 @@ func (*ControllerCsi) Probe(context.Context, *csi.ProbeRequest) (*csi.ProbeRespo
 // ControllerExpandVolume implements csi.ControllerServer.
 func (n *ControllerCsi) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
 	log.Printf("ControllerExpandVolume: %v", req)
-	dataset, err := findExistingDatasetByVolumeId(n.client, req.VolumeId)
+	host, dataset, err := n.findVolumeDataset(req.VolumeId)
 	if err != nil {
 		return nil, err
 	}
@@ -64,7 +93,42 @@ func (n *ControllerCsi) ControllerExpandVolume(ctx context.Context, req *csi.Con
 		return nil, status.Error(codes.InvalidArgument, "required bytes must be specified")
 	}
 	capacity := int64(req.CapacityRange.RequiredBytes)
-	if err := n.client.SetDatasetQuota(dataset, capacity); err != nil {
+	properties, err := host.Client.GetProperties(dataset, []string{ZFS_PROPERTY_TYPE, ZFS_PROPERTY_VOLBLOCKSIZE, ZFS_PROPERTY_BLOCK_PROTOCOL})
+	if err != nil {
+		log.Printf("Error getting properties of dataset %s: %v", dataset, err)
+		return nil, err
+	}
+	if properties[ZFS_PROPERTY_TYPE] == ZFS_TYPE_VOLUME {
+		volblocksize, err := strconv.ParseUint(properties[ZFS_PROPERTY_VOLBLOCKSIZE], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		capacity, err = growZvol(host.Client, dataset, roundVolumeSize(uint64(capacity), volblocksize))
+		if err != nil {
+			log.Printf("Error setting volsize: %v", err)
+			return nil, err
+		}
+		// lio picks up the new size of the zvol by itself, nvmet has to be told
+		if properties[ZFS_PROPERTY_BLOCK_PROTOCOL] == BLOCK_PROTOCOL_NVMEOF {
+			if err := host.Client.RevalidateNvmeofNamespace(nvmeofSubsystemNqn(req.VolumeId)); err != nil {
+				log.Printf("Error revalidating nvme-of namespace: %v", err)
+				return nil, err
+			}
+		}
+		// local block devices grow with the zvol, filesystems created on it have to be grown by the node
+		// and nodes using it over iscsi or nvme-of have to rescan it even when it is used as a raw block device
+		exported := properties[ZFS_PROPERTY_BLOCK_PROTOCOL] == BLOCK_PROTOCOL_ISCSI || properties[ZFS_PROPERTY_BLOCK_PROTOCOL] == BLOCK_PROTOCOL_NVMEOF
+		return &csi.ControllerExpandVolumeResponse{
+			CapacityBytes:         capacity,
+			NodeExpansionRequired: req.VolumeCapability.GetMount() != nil || exported,
+		}, nil
+	}
+	quotaMode, err := getVolumeQuotaMode(host.Client, dataset)
+	if err != nil {
+		log.Printf("Error getting quota mode: %v", err)
+		return nil, err
+	}
+	if err := setVolumeQuota(host.Client, dataset, quotaMode, capacity); err != nil {
 		log.Printf("Error setting quota: %v", err)
 		return nil, err
 	}
@@ -80,17 +144,17 @@ func (*ControllerCsi) ControllerGetCapabilities(context.Context, *csi.Controller
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
 		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
-		//csi.ControllerServiceCapability_RPC_GET_CAPACITY,
-		//csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
-		//csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
-		//csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
 		//csi.ControllerServiceCapability_RPC_PUBLISH_READONLY,
 		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
-		//csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
-		//csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
-		//csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
 		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
-		//csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
+		csi.ControllerServiceCapability_RPC_MODIFY_VOLUME,
 	}
 
 	res := &csi.ControllerGetCapabilitiesResponse{
@@ -111,261 +175,1752 @@ func (*ControllerCsi) ControllerGetCapabilities(context.Context, *csi.Controller
 }
 
 // ControllerGetVolume implements csi.ControllerServer.
-func (*ControllerCsi) ControllerGetVolume(context.Context, *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "get volume not supported")
-}
+func (c *ControllerCsi) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	log.Printf("ControllerGetVolume: %v", req)
 
-// ControllerModifyVolume implements csi.ControllerServer.
-func (*ControllerCsi) ControllerModifyVolume(context.Context, *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "modify volume not supported")
-}
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id must be specified")
+	}
 
-// ControllerPublishVolume implements csi.ControllerServer.
-func (c *ControllerCsi) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	// most of the work is done in NodePublishVolume
-	// in here we just make sure the dataset is shared
-	log.Printf("ControllerPublishVolume: %v", req)
-	dataset, err := findExistingDatasetByVolumeId(c.client, req.VolumeId)
+	volume := &csi.Volume{VolumeId: req.VolumeId}
+	volumeStatus, err := c.getVolumeStatus(volume)
 	if err != nil {
-		log.Printf("Error finding dataset by volume id: %v", err)
 		return nil, err
 	}
 
-	if err := c.client.ShareDataset(dataset); err != nil {
-		log.Printf("Error sharing dataset: %v", err)
-		return nil, err
+	res := &csi.ControllerGetVolumeResponse{
+		Volume: volume,
+		Status: volumeStatus,
 	}
-	return &csi.ControllerPublishVolumeResponse{}, nil
-}
-
-// ControllerUnpublishVolume implements csi.ControllerServer.
-func (*ControllerCsi) ControllerUnpublishVolume(context.Context, *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
-	// nothing to do here
-	return &csi.ControllerUnpublishVolumeResponse{}, nil
+	log.Printf("ControllerGetVolume: %v", res)
+	return res, nil
 }
 
-// CreateSnapshot implements csi.ControllerServer.
-func (*ControllerCsi) CreateSnapshot(context.Context, *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "create snapshot not supported")
-}
+// ControllerModifyVolume implements csi.ControllerServer.
+func (c *ControllerCsi) ControllerModifyVolume(ctx context.Context, req *csi.ControllerModifyVolumeRequest) (*csi.ControllerModifyVolumeResponse, error) {
+	log.Printf("ControllerModifyVolume: %v", req)
 
-// CreateVolume implements csi.ControllerServer.
-func (c *ControllerCsi) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
-	log.Printf("CreateVolume: %v", req)
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id must be specified")
+	}
+	if err := validateMutableParameters(req.MutableParameters); err != nil {
+		return nil, err
+	}
 
-	if req.CapacityRange == nil {
-		return nil, status.Error(codes.InvalidArgument, "capacity range must be specified")
+	// a volume that doesn't exist is NotFound, other errors like a lost connection to the storage host are retried
+	host, dataset, err := c.findVolumeDataset(req.VolumeId)
+	if err != nil {
+		log.Printf("Error finding dataset by volume id: %v", err)
+		return nil, err
 	}
-	if req.CapacityRange.RequiredBytes == 0 {
-		return nil, status.Error(codes.InvalidArgument, "required bytes must be specified")
+
+	properties, err := zfsPropertiesFromParameters(req.MutableParameters)
+	if err != nil {
+		return nil, err
 	}
-	// TODO: validate VolumeCapabilities
-	if req.VolumeContentSource != nil {
-		return nil, status.Error(codes.InvalidArgument, "volume content source not supported")
+	quotaMode, err := quotaModeFromParameters(req.MutableParameters)
+	if err != nil {
+		return nil, err
 	}
-	if req.AccessibilityRequirements != nil {
-		return nil, status.Error(codes.InvalidArgument, "accessibility requirements not supported")
+	datasetType, err := host.Client.GetDatasetType(dataset)
+	if err != nil {
+		log.Printf("Error getting type of dataset %s: %v", dataset, err)
+		return nil, err
 	}
-	if req.MutableParameters != nil {
-		return nil, status.Error(codes.InvalidArgument, "mutable parameters not supported")
+	if datasetType == ZFS_TYPE_VOLUME {
+		if quotaMode != "" {
+			return nil, status.Errorf(codes.InvalidArgument, "parameter %s is not supported by block volumes", PARAMETER_QUOTA_MODE)
+		}
+		if err := validateBlockVolumeProperties(properties); err != nil {
+			return nil, err
+		}
 	}
-	if req.Parameters == nil {
-		return nil, status.Error(codes.InvalidArgument, "parameters must be specified")
+	if len(properties) > 0 {
+		if err := host.Client.UpdateProperties(dataset, properties); err != nil {
+			log.Printf("Error updating properties: %v", err)
+			return nil, err
+		}
 	}
 
-	namespace := req.Parameters["csi.storage.k8s.io/pvc/namespace"]
-	if namespace == "" {
-		return nil, status.Error(codes.InvalidArgument, "namespace must be specified")
+	if quotaMode != "" {
+		capacity, err := getVolumeQuota(host.Client, dataset)
+		if err != nil {
+			log.Printf("Error getting quota of dataset %s: %v", dataset, err)
+			return nil, err
+		}
+		if err := setVolumeQuota(host.Client, dataset, quotaMode, capacity); err != nil {
+			log.Printf("Error setting quota: %v", err)
+			return nil, err
+		}
 	}
 
-	pvc := req.Parameters["csi.storage.k8s.io/pvc/name"]
-	if pvc == "" {
-		return nil, status.Error(codes.InvalidArgument, "pvc must be specified")
-	}
+	return &csi.ControllerModifyVolumeResponse{}, nil
+}
 
-	pv := req.Parameters["csi.storage.k8s.io/pv/name"]
-	if pv == "" {
-		return nil, status.Error(codes.InvalidArgument, "pv must be specified")
+// ControllerPublishVolume implements csi.ControllerServer.
+func (c *ControllerCsi) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	// most of the work is done in NodePublishVolume
+	// in here we just make sure the dataset is shared with the node
+	log.Printf("ControllerPublishVolume: %v", req)
+	host, dataset, err := c.findVolumeDataset(req.VolumeId)
+	if err != nil {
+		log.Printf("Error finding dataset by volume id: %v", err)
+		return nil, err
 	}
 
-	// we use a search by properties for backwards compatibility
-	// the name of the dataset has changed over time but the properties have not
-	// and they containing information to indentify the dataset.
-	zfsSearchProperties := map[string]string{
-		ZFS_PROPERTY_NAMESPACE: namespace,
-		ZFS_PROPERTY_PVC:       pvc,
-		ZFS_PROPERTY_DELETED:   ZFS_PROPERTY_DELETED_FALSE,
+	if err := loadVolumeKey(host, dataset, req.Secrets); err != nil {
+		log.Printf("Error loading key of dataset %s: %v", dataset, err)
+		return nil, err
 	}
 
-	zfsProperties := map[string]string{
-		ZFS_PROPERTY_SHARENFS:  ZFS_PROPERTY_SHARENFS_ON,
-		ZFS_PROPERTY_NAMESPACE: namespace,
-		ZFS_PROPERTY_PV:        pv,
-		ZFS_PROPERTY_PVC:       pvc,
-		ZFS_PROPERTY_DELETED:   ZFS_PROPERTY_DELETED_FALSE,
+	if err := c.updatePublishedNodes(host, dataset, func(nodes []string) ([]string, error) {
+		if slices.Contains(nodes, req.NodeId) {
+			return nodes, nil
+		}
+		// the volume has to be unpublished from its node before another node can use it
+		if mode := req.VolumeCapability.GetAccessMode().GetMode(); len(nodes) > 0 && isSingleNodeAccessMode(mode) {
+			return nil, status.Errorf(codes.FailedPrecondition, "volume %s with access mode %s is already published to node %s", req.VolumeId, mode, formatPublishedNodes(nodes))
+		}
+		return append(nodes, req.NodeId), nil
+	}); err != nil {
+		log.Printf("Error updating published nodes: %v", err)
+		return nil, err
 	}
 
-	datasetName := createDatasetName(c.config.ParentDataset, namespace, pvc)
-	log.Printf("searching for dataset with properties: %v", zfsSearchProperties)
-	foundDataset, err := c.client.FindDatasetByProperties(zfsSearchProperties)
+	properties, err := host.Client.GetProperties(dataset, []string{ZFS_PROPERTY_TYPE, ZFS_PROPERTY_BLOCK_PROTOCOL, ZFS_PROPERTY_PUBLISHED_NODES})
 	if err != nil {
+		log.Printf("Error getting properties of dataset %s: %v", dataset, err)
 		return nil, err
 	}
-
-	if foundDataset != "" {
-		log.Printf("found an existing dataset: %s", foundDataset)
-		if foundDataset != datasetName {
-			log.Printf("found an existing dataset with a different name: %s", foundDataset)
-			if err := c.client.RenameDataset(foundDataset, datasetName); err != nil {
-				log.Printf("Error renaming dataset: %v", err)
-				return nil, err
+	if properties[ZFS_PROPERTY_TYPE] == ZFS_TYPE_VOLUME {
+		// the nvmet configuration is lost when the storage host reboots, the other nodes the volume is published to are allowed again
+		if properties[ZFS_PROPERTY_BLOCK_PROTOCOL] == BLOCK_PROTOCOL_NVMEOF {
+			for _, node := range parsePublishedNodes(properties[ZFS_PROPERTY_PUBLISHED_NODES]) {
+				if node == req.NodeId {
+					continue
+				}
+				if _, err := exportZvol(host, dataset, req.VolumeId, BLOCK_PROTOCOL_NVMEOF, node); err != nil {
+					log.Printf("Error exporting zvol %s to node %s: %v", dataset, node, err)
+					return nil, err
+				}
 			}
 		}
-
-		log.Printf("updating properties of existing dataset: %s", datasetName)
-		c.client.UpdateProperties(datasetName, zfsProperties)
+		publishContext, err := exportZvol(host, dataset, req.VolumeId, properties[ZFS_PROPERTY_BLOCK_PROTOCOL], req.NodeId)
+		if err != nil {
+			log.Printf("Error exporting zvol %s: %v", dataset, err)
+			return nil, err
+		}
+		return &csi.ControllerPublishVolumeResponse{PublishContext: publishContext}, nil
 	}
 
-	if err := c.client.CreateDatasetIfNotExists(datasetName, zfsProperties); err != nil {
-		log.Printf("Error creating dataset: %v", err)
+	if err := host.Client.ShareDataset(dataset); err != nil {
+		log.Printf("Error sharing dataset: %v", err)
 		return nil, err
 	}
+	return &csi.ControllerPublishVolumeResponse{}, nil
+}
 
-	if err := c.client.ChmodDataset(datasetName, "777"); err != nil {
-		log.Printf("Error chmoding dataset: %v", err)
+// ControllerUnpublishVolume implements csi.ControllerServer.
+func (c *ControllerCsi) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	log.Printf("ControllerUnpublishVolume: %v", req)
+	host, err := c.hosts.FromId(req.VolumeId)
+	if err != nil {
+		log.Printf("Error finding storage host of volume id %s: %v", req.VolumeId, err)
+		return nil, err
+	}
+	dataset, err := findExistingDatasetByVolumeId(host.Client, req.VolumeId)
+	if status.Code(err) == codes.NotFound {
+		// the volume is gone, so it is not published anywhere
+		log.Printf("Volume %s not found, it is not published: %v", req.VolumeId, err)
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	if err != nil {
+		// the attacher retries, otherwise the node would keep access to the volume
+		log.Printf("Error finding dataset by volume id: %v", err)
 		return nil, err
 	}
 
-	if err := c.client.SetDatasetQuota(datasetName, int64(req.CapacityRange.RequiredBytes)); err != nil {
-		log.Printf("Error setting quota: %v", err)
+	if err := c.updatePublishedNodes(host, dataset, func(nodes []string) ([]string, error) {
+		// an empty node id means the volume should be unpublished from every node
+		if req.NodeId == "" {
+			return []string{}, nil
+		}
+		return slices.DeleteFunc(nodes, func(node string) bool { return node == req.NodeId }), nil
+	}); err != nil {
+		log.Printf("Error updating published nodes: %v", err)
 		return nil, err
 	}
 
-	if err := c.client.ShareDataset(datasetName); err != nil {
-		log.Printf("Error sharing dataset: %v", err)
+	protocol, err := host.Client.GetProperty(dataset, ZFS_PROPERTY_BLOCK_PROTOCOL)
+	if err != nil {
+		log.Printf("Error getting block protocol of dataset %s: %v", dataset, err)
+		return nil, err
+	}
+	if err := unexportZvol(host, req.VolumeId, protocol, req.NodeId); err != nil {
+		log.Printf("Error unexporting zvol %s: %v", dataset, err)
 		return nil, err
 	}
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
 
-	res := &csi.CreateVolumeResponse{
-		Volume: &csi.Volume{
-			CapacityBytes: req.CapacityRange.RequiredBytes,
-			VolumeId:      req.Name,
-		},
+// load the key of an encrypted dataset and mount it, if the key is not loaded, ex: after the storage host rebooted.
+// the key comes from the secret of the request, ex: the controller publish secret. datasets that are not encrypted are ignored.
+// clones use the key of the encryption root of their origin, which is loaded instead, even if the origin's volume was deleted.
+func loadVolumeKey(host *StorageHost, dataset string, secrets map[string]string) error {
+	properties, err := host.Client.GetProperties(dataset, []string{
+		ZFS_PROPERTY_TYPE,
+		ZFS_PROPERTY_KEYSTATUS,
+		ZFS_PROPERTY_KEYFORMAT,
+		ZFS_PROPERTY_ENCRYPTION_ROOT,
+		ZFS_PROPERTY_MOUNTED,
+	})
+	if err != nil {
+		return err
 	}
-	log.Printf("CreateVolume: %v", res)
-	return res, nil
+	if properties[ZFS_PROPERTY_KEYSTATUS] == "-" {
+		return nil
+	}
+
+	if properties[ZFS_PROPERTY_KEYSTATUS] != ZFS_KEYSTATUS_AVAILABLE {
+		root := properties[ZFS_PROPERTY_ENCRYPTION_ROOT]
+		key, err := encryptionKeyFromSecrets(secrets, properties[ZFS_PROPERTY_KEYFORMAT])
+		if err != nil {
+			return err
+		}
+		if err := host.Client.LoadKey(root, key); err != nil {
+			// the secret already contains the new key while rotate-keys has not changed the key of the dataset yet
+			previous, ok := secrets[SECRET_PREVIOUS_ENCRYPTION_KEY]
+			if !ok || host.Client.LoadKey(root, previous) != nil {
+				return err
+			}
+		}
+	}
+
+	if properties[ZFS_PROPERTY_TYPE] == ZFS_TYPE_FILESYSTEM && properties[ZFS_PROPERTY_MOUNTED] != "yes" {
+		return host.Client.MountDataset(dataset)
+	}
+	return nil
 }
 
-// DeleteSnapshot implements csi.ControllerServer.
-func (*ControllerCsi) DeleteSnapshot(context.Context, *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "delete snapshot not supported")
+// export the zvol to the node with its block protocol, returns the publish context the node needs to use it.
+// the storage node uses the zvol directly, so it is never exported to it.
+func exportZvol(host *StorageHost, dataset, volumeId, protocol, nodeId string) (map[string]string, error) {
+	if nodeId == host.Hostname {
+		return nil, nil
+	}
+	switch protocol {
+	case BLOCK_PROTOCOL_ISCSI:
+		target := iscsiTargetIqn(volumeId)
+		if err := host.Client.CreateIscsiTarget(target, exportName(volumeId), path.Join("/dev/zvol", dataset)); err != nil {
+			return nil, err
+		}
+		if err := host.Client.AddIscsiInitiator(target, iscsiInitiatorIqn(nodeId)); err != nil {
+			return nil, err
+		}
+		return map[string]string{PUBLISH_CONTEXT_ISCSI_TARGET: target}, nil
+	case BLOCK_PROTOCOL_NVMEOF:
+		nqn := nvmeofSubsystemNqn(volumeId)
+		if err := host.Client.CreateNvmeofSubsystem(nqn, path.Join("/dev/zvol", dataset)); err != nil {
+			return nil, err
+		}
+		if err := host.Client.AddNvmeofHost(nqn, nvmeofHostNqn(nodeId)); err != nil {
+			return nil, err
+		}
+		return map[string]string{PUBLISH_CONTEXT_NVMEOF_SUBSYSTEM: nqn}, nil
+	}
+	return nil, nil
 }
 
-// DeleteVolume implements csi.ControllerServer.
-func (c *ControllerCsi) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
-	log.Printf("DeleteVolume: %v", req)
-	log.Printf("Deleting volume: %s", req.VolumeId)
+// export the zvols published over nvme-of to their nodes again, ex: after the storage host rebooted.
+// unlike lio, whose configuration targetcli saves, the nvmet configuration only lives in configfs.
+func (c *ControllerCsi) RestoreNvmeofExports() {
+	for _, host := range c.hosts {
+		if err := restoreNvmeofExports(host); err != nil {
+			log.Printf("Error restoring nvme-of exports on host %s: %v", host.Name, err)
+		}
+	}
+}
 
-	dataset, err := findExistingDatasetByVolumeId(c.client, req.VolumeId)
+func restoreNvmeofExports(host *StorageHost) error {
+	parents, err := host.ParentDatasets()
 	if err != nil {
-		log.Printf("Error finding dataset by volume id: %v", err)
-		return nil, err
+		return err
+	}
+	datasets, err := host.Client.ListChildDatasetProperties(parents, []string{
+		ZFS_PROPERTY_PV,
+		ZFS_PROPERTY_TYPE,
+		ZFS_PROPERTY_BLOCK_PROTOCOL,
+		ZFS_PROPERTY_PUBLISHED_NODES,
+	})
+	if err != nil {
+		return err
+	}
+	for _, dataset := range datasets {
+		if dataset[ZFS_PROPERTY_TYPE] != ZFS_TYPE_VOLUME || dataset[ZFS_PROPERTY_BLOCK_PROTOCOL] != BLOCK_PROTOCOL_NVMEOF {
+			continue
+		}
+		for _, node := range parsePublishedNodes(dataset[ZFS_PROPERTY_PUBLISHED_NODES]) {
+			// one volume that can't be exported doesn't keep the others from being restored
+			if _, err := exportZvol(host, dataset[ZFS_PROPERTY_NAME], dataset[ZFS_PROPERTY_PV], BLOCK_PROTOCOL_NVMEOF, node); err != nil {
+				log.Printf("Error exporting zvol %s to node %s: %v", dataset[ZFS_PROPERTY_NAME], node, err)
+			}
+		}
+	}
+	return nil
+}
+
+// stop exporting the zvol to the node, or to every node if the node id is empty.
+// the export is removed once no node can use it. datasets that are not exported are ignored.
+func unexportZvol(host *StorageHost, volumeId, protocol, nodeId string) error {
+	switch protocol {
+	case BLOCK_PROTOCOL_ISCSI:
+		target := iscsiTargetIqn(volumeId)
+		targets, err := host.Client.ListIscsiTargets()
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(targets, target) {
+			return nil
+		}
+		if nodeId != "" {
+			if err := host.Client.RemoveIscsiInitiator(target, iscsiInitiatorIqn(nodeId)); err != nil {
+				return err
+			}
+		}
+		initiators, err := host.Client.ListIscsiInitiators(target)
+		if err != nil {
+			return err
+		}
+		if nodeId == "" || len(initiators) == 0 {
+			return host.Client.DeleteIscsiTarget(target, exportName(volumeId))
+		}
+	case BLOCK_PROTOCOL_NVMEOF:
+		nqn := nvmeofSubsystemNqn(volumeId)
+		subsystems, err := host.Client.ListNvmeofSubsystems()
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(subsystems, nqn) {
+			return nil
+		}
+		if nodeId != "" {
+			if err := host.Client.RemoveNvmeofHost(nqn, nvmeofHostNqn(nodeId)); err != nil {
+				return err
+			}
+		}
+		hosts, err := host.Client.ListNvmeofHosts(nqn)
+		if err != nil {
+			return err
+		}
+		if nodeId == "" || len(hosts) == 0 {
+			return host.Client.DeleteNvmeofSubsystem(nqn)
+		}
 	}
+	return nil
+}
 
-	exists, err := c.client.DatasetExists(dataset)
+// read, modify and write the list of nodes the dataset is published to.
+// the nfs export of the dataset is restricted to the addresses of the published nodes.
+// zvols are not exported, only their published nodes are recorded.
+func (c *ControllerCsi) updatePublishedNodes(host *StorageHost, dataset string, update func([]string) ([]string, error)) error {
+	// the attacher publishes volumes concurrently, without the lock updates to the same dataset could be lost
+	c.publishLock.Lock()
+	defer c.publishLock.Unlock()
+
+	properties, err := host.Client.GetProperties(dataset, []string{ZFS_PROPERTY_PUBLISHED_NODES, ZFS_PROPERTY_SHARENFS, ZFS_PROPERTY_TYPE})
 	if err != nil {
-		log.Printf("Error checking if dataset exists: %v", err)
-		return nil, err
+		return err
+	}
+	nodes := parsePublishedNodes(properties[ZFS_PROPERTY_PUBLISHED_NODES])
+	updated, err := update(slices.Clone(nodes))
+	if err != nil {
+		return err
 	}
+	slices.Sort(updated)
 
-	timestamp := time.Now().Unix()
-	deletedDatasetName := fmt.Sprintf("%s-%d", dataset, timestamp)
+	if properties[ZFS_PROPERTY_TYPE] == ZFS_TYPE_VOLUME {
+		if slices.Equal(nodes, updated) {
+			return nil
+		}
+		log.Printf("Updating published nodes of %s to %v", dataset, updated)
+		return writePublishedNodes(host.Client, dataset, updated)
+	}
 
-	if exists {
-		log.Printf("Dataset exists, deleting: %s", dataset)
-		if err := c.client.UpdateProperty(dataset, ZFS_PROPERTY_DELETED, ZFS_PROPERTY_DELETED_TRUE); err != nil {
-			log.Printf("Error setting deleted property: %v", err)
-			return nil, err
+	addresses := []string{}
+	for _, node := range updated {
+		address, err := c.resolveNodeAddress(node)
+		if err != nil && slices.Contains(nodes, node) {
+			// a node that was removed from the cluster without unpublishing its volumes must not keep the others from being published or unpublished
+			log.Printf("Leaving node %s out of the nfs export of %s: %v", node, dataset, err)
+			continue
 		}
-		if err := c.client.RenameDataset(dataset, deletedDatasetName); err != nil {
-			log.Printf("Error renaming dataset: %v", err)
-			return nil, err
+		if err != nil {
+			return err
 		}
-	} else {
-		log.Printf("Dataset does not exist, skipping deletion: %s", dataset)
+		addresses = append(addresses, address)
 	}
+	sharenfs := sharenfsAccessList(addresses)
 
-	return &csi.DeleteVolumeResponse{}, nil
+	// the sharenfs is also compared so volumes created before access lists existed are converted
+	if slices.Equal(nodes, updated) && properties[ZFS_PROPERTY_SHARENFS] == sharenfs {
+		return nil
+	}
+	log.Printf("Updating published nodes of %s to %v with sharenfs %s", dataset, updated, sharenfs)
+	if err := host.Client.UpdateProperty(dataset, ZFS_PROPERTY_SHARENFS, sharenfs); err != nil {
+		return err
+	}
+	return writePublishedNodes(host.Client, dataset, updated)
 }
 
-// GetCapacity implements csi.ControllerServer.
-func (*ControllerCsi) GetCapacity(context.Context, *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "get capacity not supported")
+// set the published nodes of the dataset, an empty list removes the property instead of setting it to an empty value.
+func writePublishedNodes(client *ZfsClient, dataset string, nodes []string) error {
+	if len(nodes) == 0 {
+		return client.InheritProperty(dataset, ZFS_PROPERTY_PUBLISHED_NODES)
+	}
+	return client.UpdateProperty(dataset, ZFS_PROPERTY_PUBLISHED_NODES, formatPublishedNodes(nodes))
 }
 
-// ListSnapshots implements csi.ControllerServer.
-func (*ControllerCsi) ListSnapshots(context.Context, *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "list snapshots not supported")
+// resolve the address the node uses to mount nfs exports.
+// addresses configured in NfsNodeAddresses take precedence over dns.
+func (c *ControllerCsi) resolveNodeAddress(nodeId string) (string, error) {
+	if address, ok := c.config.NfsNodeAddresses[nodeId]; ok {
+		return address, nil
+	}
+	addresses, err := net.LookupHost(nodeId)
+	if err != nil {
+		log.Printf("Error looking up address of node %s: %v", nodeId, err)
+		return "", status.Errorf(codes.FailedPrecondition, "could not resolve the address of node %s, add it to %s: %v", nodeId, ENV_STORAGE_NFS_NODE_ADDRESSES, err)
+	}
+	for _, address := range addresses {
+		// prefer ipv4 since the nfs client picks it first when the storage host has both
+		if ip := net.ParseIP(address); ip != nil && ip.To4() != nil {
+			return address, nil
+		}
+	}
+	if len(addresses) == 0 {
+		return "", status.Errorf(codes.FailedPrecondition, "no addresses found for node %s", nodeId)
+	}
+	return addresses[0], nil
 }
 
-// ListVolumes implements csi.ControllerServer.
-func (c *ControllerCsi) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	if req.MaxEntries != 0 {
-		return nil, status.Error(codes.InvalidArgument, "max entries not supported")
+// CreateSnapshot implements csi.ControllerServer.
+func (c *ControllerCsi) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	log.Printf("CreateSnapshot: %v", req)
+
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "snapshot name must be specified")
 	}
-	if req.StartingToken != "" {
-		return nil, status.Error(codes.InvalidArgument, "starting token not supported")
+	if req.SourceVolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "source volume id must be specified")
 	}
 
-	volumes := []*csi.Volume{}
-	if datasets, err := c.client.ListChildDatasets(c.config.ParentDataset); err == nil {
-		for _, dataset := range datasets {
-			if dataset.quota == nil {
-				// quota should never be nil since we require it when creating a dataset
-				return nil, status.Error(codes.Internal, "dataset quota is nil")
-			}
-
-			deleted, err := c.client.GetProperty(dataset.name, ZFS_PROPERTY_DELETED)
-			if err != nil {
-				log.Printf("Error getting deleted property: %v", err)
-				return nil, err
-			}
+	host, err := c.hosts.FromId(req.SourceVolumeId)
+	if err != nil {
+		return nil, err
+	}
+	snapshotId := host.Id(req.Name)
 
-			if deleted != ZFS_PROPERTY_DELETED_FALSE {
-				log.Printf("Dataset is marked as deleted: %s", dataset.name)
-				continue
-			}
+	existing, err := findSnapshotById(host, snapshotId)
+	if err != nil {
+		log.Printf("Error finding snapshot by id: %v", err)
+		return nil, err
+	}
+	if existing != nil {
+		if existing.properties[ZFS_PROPERTY_SNAPSHOT_SOURCE] != req.SourceVolumeId {
+			return nil, status.Errorf(codes.AlreadyExists, "snapshot %s already exists for a different volume", req.Name)
+		}
+		log.Printf("found an existing snapshot: %s", existing.name)
+		res := &csi.CreateSnapshotResponse{Snapshot: csiSnapshotFromInfo(existing)}
+		log.Printf("CreateSnapshot: %v", res)
+		return res, nil
+	}
 
-			volumeId, err := c.client.GetProperty(dataset.name, ZFS_PROPERTY_PV)
-			if err != nil {
-				log.Printf("Error getting pv property: %v", err)
-				return nil, err
-			}
+	dataset, err := findExistingDatasetByVolumeId(host.Client, req.SourceVolumeId)
+	if err != nil {
+		log.Printf("Error finding dataset by volume id: %v", err)
+		return nil, err
+	}
 
-			volumes = append(volumes, &csi.Volume{
-				CapacityBytes: int64(*dataset.quota),
-				VolumeId:      volumeId,
-			})
-		}
-	} else {
-		log.Printf("Error listing datasets: %v", err)
+	snapshotName := fmt.Sprintf("%s@%s", dataset, req.Name)
+	if err := host.Client.CreateSnapshot(snapshotName, map[string]string{
+		ZFS_PROPERTY_SNAPSHOT:        snapshotId,
+		ZFS_PROPERTY_SNAPSHOT_SOURCE: req.SourceVolumeId,
+	}); err != nil {
 		return nil, err
 	}
 
-	entries := []*csi.ListVolumesResponse_Entry{}
-	for _, volume := range volumes {
-		entries = append(entries, &csi.ListVolumesResponse_Entry{
-			Volume: volume,
-		})
+	snapshot, err := findSnapshotById(host, snapshotId)
+	if err != nil {
+		log.Printf("Error finding snapshot by id: %v", err)
+		return nil, err
 	}
-	res := &csi.ListVolumesResponse{
-		Entries: entries,
+	if snapshot == nil {
+		return nil, status.Errorf(codes.Internal, "snapshot %s not found after creation", snapshotName)
 	}
-	log.Printf("ListVolumes: %v", res)
+
+	res := &csi.CreateSnapshotResponse{Snapshot: csiSnapshotFromInfo(snapshot)}
+	log.Printf("CreateSnapshot: %v", res)
 	return res, nil
 }
 
-// ValidateVolumeCapabilities implements csi.ControllerServer.
-func (*ControllerCsi) ValidateVolumeCapabilities(context.Context, *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "validate volume capabilities not supported")
+// CreateVolume implements csi.ControllerServer.
+func (c *ControllerCsi) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	log.Printf("CreateVolume: %v", req)
+
+	if req.CapacityRange == nil {
+		return nil, status.Error(codes.InvalidArgument, "capacity range must be specified")
+	}
+	if req.CapacityRange.RequiredBytes == 0 {
+		return nil, status.Error(codes.InvalidArgument, "required bytes must be specified")
+	}
+	if len(req.VolumeCapabilities) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume capabilities must be specified")
+	}
+	if err := validateVolumeCapabilities(req.VolumeCapabilities); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if req.VolumeContentSource != nil && req.VolumeContentSource.GetSnapshot() == nil && req.VolumeContentSource.GetVolume() == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume content source not supported")
+	}
+	if req.Parameters == nil {
+		return nil, status.Error(codes.InvalidArgument, "parameters must be specified")
+	}
+	if err := validateMutableParameters(req.MutableParameters); err != nil {
+		return nil, err
+	}
+
+	// mutable parameters from the VolumeAttributesClass take precedence over the storage class
+	parameters := map[string]string{}
+	for k, v := range req.Parameters {
+		parameters[k] = v
+	}
+	for k, v := range req.MutableParameters {
+		parameters[k] = v
+	}
+
+	namespace := req.Parameters["csi.storage.k8s.io/pvc/namespace"]
+	if namespace == "" {
+		return nil, status.Error(codes.InvalidArgument, "namespace must be specified")
+	}
+
+	pvc := req.Parameters["csi.storage.k8s.io/pvc/name"]
+	if pvc == "" {
+		return nil, status.Error(codes.InvalidArgument, "pvc must be specified")
+	}
+
+	host, err := c.hosts.FromParameters(req.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	volumeId := host.Id(req.Name)
+
+	parameterProperties, err := zfsPropertiesFromParameters(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	blockProtocol, err := blockProtocolFromParameters(parameters)
+	if err != nil {
+		return nil, err
+	}
+	fsType, err := fsTypeFromParameters(parameters)
+	if err != nil {
+		return nil, err
+	}
+	ownership, err := ownershipFromParameters(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	// block volumes and volumes exported with a block protocol are backed by zvols instead of filesystems
+	block := isBlockVolume(req.VolumeCapabilities)
+	zvol := block || blockProtocol != BLOCK_PROTOCOL_LOCAL
+	volblocksize, err := volblocksizeFromParameters(parameters)
+	if err != nil {
+		return nil, err
+	}
+	if zvol {
+		if err := validateBlockVolumeProperties(parameterProperties); err != nil {
+			return nil, err
+		}
+		// a filesystem on a zvol can only be mounted by one node at a time
+		if err := validateZvolAccessModes(req.VolumeCapabilities); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	} else if volblocksize != 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "parameter %s is only supported by block volumes", PARAMETER_VOLBLOCKSIZE)
+	}
+
+	placement, err := placementFromParameters(parameters)
+	if err != nil {
+		return nil, err
+	}
+	if zvol && blockProtocol == BLOCK_PROTOCOL_LOCAL {
+		// zvols that are not exported can only be used by the storage node
+		if _, ok := parameters[PARAMETER_PLACEMENT]; !ok {
+			placement = PLACEMENT_LOCAL
+		}
+		if placement != PLACEMENT_LOCAL {
+			return nil, status.Errorf(codes.InvalidArgument, "block volumes with %s %s require %s %s", PARAMETER_BLOCK_PROTOCOL, BLOCK_PROTOCOL_LOCAL, PARAMETER_PLACEMENT, PLACEMENT_LOCAL)
+		}
+	}
+	accessibleTopology, err := volumeTopology(host, placement, req.AccessibilityRequirements)
+	if err != nil {
+		return nil, err
+	}
+
+	parentCandidates, err := parentDatasetsFromParameters(parameters, host.ParentDataset)
+	if err != nil {
+		return nil, err
+	}
+	parentPolicy, err := parentDatasetPolicyFromParameters(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	quotaMode, err := quotaModeFromParameters(parameters)
+	if err != nil {
+		return nil, err
+	}
+	if quotaMode == "" {
+		quotaMode = QUOTA_MODE_QUOTA
+	}
+
+	deletedRetention, err := deletedRetentionFromParameters(parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	restoreVolumeId, restoreNamespace, restorePvc, err := restoreDeletedFromParameters(req.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	restoreDeleted := restoreVolumeId != "" || restorePvc != ""
+	if restoreDeleted && req.VolumeContentSource != nil {
+		return nil, status.Error(codes.InvalidArgument, "a deleted volume cannot be restored into a volume with a content source")
+	}
+
+	// encryption can only be set when the dataset is created, restored and cloned datasets keep the one of their source
+	encryptionProperties, encryptionKey, err := encryptionFromParameters(parameters, req.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	if len(encryptionProperties) > 0 && (restoreDeleted || req.VolumeContentSource != nil) {
+		return nil, status.Errorf(codes.InvalidArgument, "parameter %s is not supported for volumes with a content source or restored from a deleted volume", PARAMETER_ENCRYPTION)
+	}
+	if restoreVolumeId != "" {
+		restoreHost, err := c.hosts.FromId(restoreVolumeId)
+		if err != nil {
+			return nil, err
+		}
+		if restoreHost != host {
+			return nil, status.Errorf(codes.InvalidArgument, "deleted volume %s is on storage host %s, it can only be restored on the same host", restoreVolumeId, restoreHost.Name)
+		}
+	}
+
+	deletePolicy, err := deletePolicyFromParameters(parameters)
+	if err != nil {
+		return nil, err
+	}
+	if deletePolicy == DELETE_POLICY_SNAPSHOT && host.ArchiveDataset == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "%s %s requires the archive dataset of storage host %s to be set", PARAMETER_DELETE_POLICY, DELETE_POLICY_SNAPSHOT, host.Name)
+	}
+
+	restoreMode := req.Parameters[PARAMETER_SNAPSHOT_RESTORE_MODE]
+	if restoreMode == "" {
+		restoreMode = SNAPSHOT_RESTORE_MODE_CLONE
+	}
+	if restoreMode != SNAPSHOT_RESTORE_MODE_CLONE && restoreMode != SNAPSHOT_RESTORE_MODE_PROMOTE && restoreMode != SNAPSHOT_RESTORE_MODE_COPY {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s: %s", PARAMETER_SNAPSHOT_RESTORE_MODE, restoreMode)
+	}
+
+	// we use a search by properties for backwards compatibility
+	// the name of the dataset has changed over time but the properties have not
+	// and they containing information to indentify the dataset.
+	zfsSearchProperties := map[string]string{
+		ZFS_PROPERTY_NAMESPACE: namespace,
+		ZFS_PROPERTY_PVC:       pvc,
+		ZFS_PROPERTY_DELETED:   ZFS_PROPERTY_DELETED_FALSE,
+	}
+
+	zfsProperties := map[string]string{
+		// the dataset is only shared with the nodes it gets published to
+		ZFS_PROPERTY_SHARENFS:  ZFS_PROPERTY_SHARENFS_OFF,
+		ZFS_PROPERTY_NAMESPACE: namespace,
+		ZFS_PROPERTY_PV:        volumeId,
+		ZFS_PROPERTY_PVC:       pvc,
+		ZFS_PROPERTY_DELETED:   ZFS_PROPERTY_DELETED_FALSE,
+		// stored so editing the storage class doesn't change what happens to existing volumes
+		ZFS_PROPERTY_DELETE_POLICY: deletePolicy,
+	}
+	for k, v := range parameterProperties {
+		zfsProperties[k] = v
+	}
+	if deletedRetention != "" {
+		zfsProperties[ZFS_PROPERTY_DELETED_RETENTION] = deletedRetention
+	}
+	datasetType := ZFS_TYPE_FILESYSTEM
+	if zvol {
+		datasetType = ZFS_TYPE_VOLUME
+		delete(zfsProperties, ZFS_PROPERTY_SHARENFS)
+		zfsProperties[ZFS_PROPERTY_BLOCK_PROTOCOL] = blockProtocol
+	}
+
+	log.Printf("searching for dataset on host %s with properties: %v", host.Name, zfsSearchProperties)
+	foundDataset, err := host.Client.FindDatasetByProperties(zfsSearchProperties)
+	if err != nil {
+		return nil, err
+	}
+
+	restored := false
+	if foundDataset == "" && restoreDeleted {
+		// the deleted dataset is renamed back into place like any other existing dataset
+		foundDataset, err = findDeletedDataset(host, restoreVolumeId, restoreNamespace, restorePvc)
+		if err != nil {
+			log.Printf("Error finding deleted dataset: %v", err)
+			return nil, err
+		}
+		if foundDataset == "" {
+			return nil, status.Errorf(codes.NotFound, "no deleted volume found to restore, %s: %s, %s: %s", PARAMETER_RESTORE_DELETED_VOLUME_ID, restoreVolumeId, PARAMETER_RESTORE_DELETED_PVC, req.Parameters[PARAMETER_RESTORE_DELETED_PVC])
+		}
+		log.Printf("restoring deleted dataset: %s", foundDataset)
+		restored = true
+	}
+
+	// the source of the volume is needed to pick the parent dataset, clones must be in the pool of their origin
+	var snapshot *ZfsSnapshotInfo
+	sourceVolumeId, sourceDataset := "", ""
+	if foundDataset == "" && req.VolumeContentSource.GetSnapshot() != nil {
+		snapshotId := req.VolumeContentSource.GetSnapshot().SnapshotId
+		snapshotHost, err := c.hosts.FromId(snapshotId)
+		if err != nil {
+			return nil, err
+		}
+		if snapshotHost != host {
+			return nil, status.Errorf(codes.InvalidArgument, "snapshot %s is on storage host %s, volumes can only be restored on the same host", snapshotId, snapshotHost.Name)
+		}
+		snapshot, err = findSnapshotById(host, snapshotId)
+		if err != nil {
+			log.Printf("Error finding snapshot by id: %v", err)
+			return nil, err
+		}
+		if snapshot == nil {
+			return nil, status.Errorf(codes.NotFound, "snapshot not found: %s", snapshotId)
+		}
+		// the quota of a smaller volume would be exceeded by the restored data right away
+		if uint64(req.CapacityRange.RequiredBytes) < snapshot.referenced {
+			return nil, status.Errorf(codes.OutOfRange, "requested capacity %d is smaller than the size %d of snapshot %s", req.CapacityRange.RequiredBytes, snapshot.referenced, snapshotId)
+		}
+		sourceDataset = snapshot.name
+	}
+
+	if foundDataset == "" && req.VolumeContentSource.GetVolume() != nil {
+		sourceVolumeId = req.VolumeContentSource.GetVolume().VolumeId
+		sourceHost, err := c.hosts.FromId(sourceVolumeId)
+		if err != nil {
+			return nil, err
+		}
+		if sourceHost != host {
+			return nil, status.Errorf(codes.InvalidArgument, "volume %s is on storage host %s, volumes can only be cloned on the same host", sourceVolumeId, sourceHost.Name)
+		}
+		sourceDataset, err = findExistingDatasetByVolumeId(host.Client, sourceVolumeId)
+		if err != nil {
+			log.Printf("Error finding dataset by volume id: %v", err)
+			return nil, status.Errorf(codes.NotFound, "source volume not found: %s", sourceVolumeId)
+		}
+	}
+
+	for _, dataset := range []string{foundDataset, sourceDataset} {
+		if dataset == "" {
+			continue
+		}
+		// the type of snapshots is snapshot, the type of their dataset is the one that matters
+		dataset, _, _ = strings.Cut(dataset, "@")
+		existingType, err := host.Client.GetDatasetType(dataset)
+		if err != nil {
+			log.Printf("Error getting type of dataset %s: %v", dataset, err)
+			return nil, err
+		}
+		if existingType != datasetType {
+			return nil, status.Errorf(codes.InvalidArgument, "dataset %s is a %s but the volume needs a %s", dataset, existingType, datasetType)
+		}
+	}
+
+	parentDataset := ""
+	if foundDataset != "" {
+		// existing volumes stay in the parent dataset they were created in, even if the storage class doesn't list it anymore.
+		// moving them to another candidate would fail for candidates in other pools, zfs can't rename across pools
+		parentDataset = path.Dir(foundDataset)
+	} else {
+		if sourceDataset != "" && restoreMode != SNAPSHOT_RESTORE_MODE_COPY {
+			pool, _, _ := strings.Cut(sourceDataset, "/")
+			parentCandidates = slices.DeleteFunc(parentCandidates, func(candidate ParentDatasetCandidate) bool {
+				return !isDatasetOrDescendant(candidate.Dataset, pool)
+			})
+			if len(parentCandidates) == 0 {
+				return nil, status.Errorf(codes.InvalidArgument, "none of the parent datasets are in pool %s of the volume source, use %s %s to restore it to another pool", pool, PARAMETER_SNAPSHOT_RESTORE_MODE, SNAPSHOT_RESTORE_MODE_COPY)
+			}
+		}
+		parentDataset, err = c.selectParentDataset(host, parentCandidates, parentPolicy, uint64(req.CapacityRange.RequiredBytes))
+		if err != nil {
+			return nil, err
+		}
+	}
+	zfsProperties[ZFS_PROPERTY_PARENT_DATASET] = parentDataset
+	datasetName := createDatasetName(parentDataset, namespace, pvc)
+
+	if foundDataset != "" {
+		log.Printf("found an existing dataset: %s", foundDataset)
+		if foundDataset != datasetName {
+			log.Printf("found an existing dataset with a different name: %s", foundDataset)
+			if err := host.Client.RenameDataset(foundDataset, datasetName); err != nil {
+				log.Printf("Error renaming dataset: %v", err)
+				return nil, err
+			}
+		}
+
+		// the dataset may already be published, its sharenfs is managed by updatePublishedNodes.
+		// a restored dataset is not published anywhere yet, so it stops being shared with the nodes it had
+		existingProperties := maps.Clone(zfsProperties)
+		if !restored {
+			delete(existingProperties, ZFS_PROPERTY_SHARENFS)
+		}
+		log.Printf("updating properties of existing dataset: %s", datasetName)
+		host.Client.UpdateProperties(datasetName, existingProperties)
+	}
+
+	if restored {
+		// the restored volume is a new volume, it was not deleted and is not published anywhere yet
+		for _, property := range []string{ZFS_PROPERTY_DELETED_AT, ZFS_PROPERTY_PUBLISHED_NODES} {
+			if err := host.Client.InheritProperty(datasetName, property); err != nil {
+				log.Printf("Error resetting property %s: %v", property, err)
+				return nil, err
+			}
+		}
+	}
+
+	if snapshot != nil {
+		if err := restoreSnapshot(host, snapshot.name, datasetName, zfsProperties, restoreMode); err != nil {
+			log.Printf("Error restoring snapshot: %v", err)
+			return nil, err
+		}
+	}
+
+	if sourceVolumeId != "" {
+		if err := cloneVolume(host, sourceVolumeId, req.Name, datasetName, zfsProperties, restoreMode); err != nil {
+			log.Printf("Error cloning volume: %v", err)
+			return nil, err
+		}
+	}
+
+	capacity := req.CapacityRange.RequiredBytes
+	if zvol {
+		size := roundVolumeSize(uint64(capacity), volblocksize)
+		zvolProperties := maps.Clone(zfsProperties)
+		maps.Copy(zvolProperties, encryptionProperties)
+		if volblocksize != 0 {
+			zvolProperties[ZFS_PROPERTY_VOLBLOCKSIZE] = fmt.Sprintf("%d", volblocksize)
+		}
+		if err := host.Client.CreateZvolIfNotExists(datasetName, size, zvolProperties, encryptionKey); err != nil {
+			log.Printf("Error creating zvol: %v", err)
+			return nil, err
+		}
+		// existing, restored and cloned zvols keep their size if it is already larger
+		capacity, err = growZvol(host.Client, datasetName, size)
+		if err != nil {
+			log.Printf("Error setting volsize: %v", err)
+			return nil, err
+		}
+	} else {
+		datasetProperties := maps.Clone(zfsProperties)
+		maps.Copy(datasetProperties, encryptionProperties)
+		if err := host.Client.CreateDatasetIfNotExists(datasetName, datasetProperties, encryptionKey); err != nil {
+			log.Printf("Error creating dataset: %v", err)
+			return nil, err
+		}
+
+		// datasets restored or cloned from an encrypted source are not mounted while the key of their encryption root is not loaded,
+		// ex: after a raw zfs recv, so the key is loaded before their mountpoint is used
+		if err := loadVolumeKey(host, datasetName, req.Secrets); err != nil {
+			log.Printf("Error loading key of dataset %s: %v", datasetName, err)
+			return nil, err
+		}
+
+		// volumes without a mode are not writable by everyone, which zvols with a new filesystem aren't either
+		mode := ownership.Mode
+		if mode == "" {
+			mode = DEFAULT_VOLUME_MODE
+		}
+		if err := host.Client.ChownDataset(datasetName, ownership.Uid, ownership.Gid); err != nil {
+			log.Printf("Error chowning dataset: %v", err)
+			return nil, err
+		}
+		if err := host.Client.ChmodDataset(datasetName, mode); err != nil {
+			log.Printf("Error chmoding dataset: %v", err)
+			return nil, err
+		}
+
+		if err := setVolumeQuota(host.Client, datasetName, quotaMode, int64(req.CapacityRange.RequiredBytes)); err != nil {
+			log.Printf("Error setting quota: %v", err)
+			return nil, err
+		}
+	}
+
+	res := &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			CapacityBytes:      capacity,
+			VolumeId:           volumeId,
+			ContentSource:      req.VolumeContentSource,
+			AccessibleTopology: accessibleTopology,
+			VolumeContext: map[string]string{
+				PARAMETER_PLACEMENT: placement,
+			},
+		},
+	}
+	if zvol {
+		res.Volume.VolumeContext[PARAMETER_BLOCK_PROTOCOL] = blockProtocol
+		res.Volume.VolumeContext[PARAMETER_FS_TYPE] = fsType
+		// the node applies the ownership when it creates the filesystem of the zvol
+		for _, parameter := range OWNERSHIP_PARAMETERS {
+			if value, ok := parameters[parameter]; ok {
+				res.Volume.VolumeContext[parameter] = value
+			}
+		}
+	}
+	log.Printf("CreateVolume: %v", res)
+	return res, nil
+}
+
+// DeleteSnapshot implements csi.ControllerServer.
+func (c *ControllerCsi) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	log.Printf("DeleteSnapshot: %v", req)
+
+	if req.SnapshotId == "" {
+		return nil, status.Error(codes.InvalidArgument, "snapshot id must be specified")
+	}
+
+	host, err := c.hosts.FromId(req.SnapshotId)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, err := findSnapshotById(host, req.SnapshotId)
+	if err != nil {
+		log.Printf("Error finding snapshot by id: %v", err)
+		return nil, err
+	}
+	if snapshot == nil {
+		log.Printf("Snapshot does not exist, skipping deletion: %s", req.SnapshotId)
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	if hasClones(snapshot) {
+		// volumes restored from this snapshot still depend on it, it will be destroyed once they are gone
+		log.Printf("Snapshot has dependent clones, releasing it: %s", snapshot.name)
+		if err := host.Client.UpdateProperty(snapshot.name, ZFS_PROPERTY_RELEASED, ZFS_PROPERTY_RELEASED_TRUE); err != nil {
+			log.Printf("Error setting released property: %v", err)
+			return nil, err
+		}
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	if err := host.Client.DestroySnapshot(snapshot.name); err != nil {
+		return nil, err
+	}
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+// DeleteVolume implements csi.ControllerServer.
+func (c *ControllerCsi) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	log.Printf("DeleteVolume: %v", req)
+	log.Printf("Deleting volume: %s", req.VolumeId)
+
+	host, dataset, err := c.findVolumeDataset(req.VolumeId)
+	if err != nil {
+		log.Printf("Error finding dataset by volume id: %v", err)
+		return nil, err
+	}
+
+	exists, err := host.Client.DatasetExists(dataset)
+	if err != nil {
+		log.Printf("Error checking if dataset exists: %v", err)
+		return nil, err
+	}
+
+	if exists {
+		properties, err := host.Client.GetProperties(dataset, []string{ZFS_PROPERTY_DELETE_POLICY, ZFS_PROPERTY_BLOCK_PROTOCOL})
+		if err != nil {
+			log.Printf("Error getting delete policy: %v", err)
+			return nil, err
+		}
+		// the export keeps the zvol busy, it would not be destroyed and could be used by nodes after the rename
+		if err := unexportZvol(host, req.VolumeId, properties[ZFS_PROPERTY_BLOCK_PROTOCOL], ""); err != nil {
+			log.Printf("Error unexporting zvol %s: %v", dataset, err)
+			return nil, err
+		}
+		policy := properties[ZFS_PROPERTY_DELETE_POLICY]
+		if policy == "-" {
+			// volumes created before delete policies existed
+			policy = DELETE_POLICY_SOFT
+		}
+		log.Printf("Dataset exists, deleting with policy %s: %s", policy, dataset)
+
+		destroyed := false
+		switch policy {
+		case DELETE_POLICY_SNAPSHOT:
+			if err := archiveVolume(host, dataset, req.VolumeId); err != nil {
+				log.Printf("Error archiving dataset: %v", err)
+				return nil, err
+			}
+			fallthrough
+		case DELETE_POLICY_DESTROY:
+			destroyed, err = destroyVolumeDataset(host, dataset)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if !destroyed {
+			if err := softDeleteDataset(host, dataset); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		log.Printf("Dataset does not exist, skipping deletion: %s", dataset)
+	}
+
+	if err := destroyReleasedSnapshots(host); err != nil {
+		// not fatal, released snapshots are retried on the next deletion
+		log.Printf("Error destroying released snapshots: %v", err)
+	}
+
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+// mark the dataset as deleted and rename it out of the way, the garbage collector destroys it later.
+// a clone keeps its origin snapshot until then, released snapshots are only destroyed once their clones are gone.
+func softDeleteDataset(host *StorageHost, dataset string) error {
+	timestamp := time.Now().Unix()
+	deletedDatasetName := fmt.Sprintf("%s-%d", dataset, timestamp)
+
+	if err := host.Client.UpdateProperties(dataset, map[string]string{
+		ZFS_PROPERTY_DELETED:    ZFS_PROPERTY_DELETED_TRUE,
+		ZFS_PROPERTY_DELETED_AT: fmt.Sprintf("%d", timestamp),
+	}); err != nil {
+		log.Printf("Error setting deleted property: %v", err)
+		return err
+	}
+	if err := host.Client.RenameDataset(dataset, deletedDatasetName); err != nil {
+		log.Printf("Error renaming dataset: %v", err)
+		return err
+	}
+	return nil
+}
+
+// destroy the dataset of a deleted volume right away.
+// datasets with volume snapshots or clones can't be destroyed yet, false is returned and they should be soft deleted instead.
+func destroyVolumeDataset(host *StorageHost, dataset string) (bool, error) {
+	inUse, err := deletedDatasetInUse(host.Client, dataset)
+	if err != nil {
+		log.Printf("Error checking if dataset %s is in use: %v", dataset, err)
+		return false, err
+	}
+	if inUse != "" {
+		log.Printf("Dataset %s can't be destroyed yet, soft deleting it: %s", dataset, inUse)
+		return false, nil
+	}
+	if err := host.Client.DestroyDataset(dataset); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// copy the current contents of the volume's dataset into the archive dataset of the host.
+// the copy is named after the dataset and the volume so retries and later volumes of the same pvc don't collide.
+func archiveVolume(host *StorageHost, dataset, volumeId string) error {
+	if host.ArchiveDataset == "" {
+		return status.Errorf(codes.FailedPrecondition, "delete policy %s requires the archive dataset of storage host %s to be set", DELETE_POLICY_SNAPSHOT, host.Name)
+	}
+
+	_, volumeName, ok := strings.Cut(volumeId, STORAGE_HOST_ID_SEPARATOR)
+	if !ok {
+		volumeName = volumeId
+	}
+	archiveName := fmt.Sprintf("%s/%s-%s", strings.TrimSuffix(host.ArchiveDataset, "/"), path.Base(dataset), volumeName)
+	exists, err := host.Client.DatasetExists(archiveName)
+	if err != nil {
+		return err
+	}
+	if exists {
+		log.Printf("Archive already exists, skipping copy: %s", archiveName)
+		return nil
+	}
+
+	snapshotName := fmt.Sprintf("%s@%s", dataset, ARCHIVE_SNAPSHOT_NAME)
+	snapshots, err := host.Client.ListSnapshots([]string{dataset}, []string{})
+	if err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(snapshots, func(snapshot ZfsSnapshotInfo) bool { return snapshot.name == snapshotName }) {
+		if err := host.Client.CreateSnapshot(snapshotName, map[string]string{}); err != nil {
+			return err
+		}
+	}
+
+	properties, err := host.Client.GetProperties(dataset, []string{ZFS_PROPERTY_NAMESPACE, ZFS_PROPERTY_PVC, ZFS_PROPERTY_TYPE})
+	if err != nil {
+		return err
+	}
+	if err := host.Client.CreateDatasetIfNotExists(host.ArchiveDataset, map[string]string{}, ""); err != nil {
+		return err
+	}
+	archiveProperties := map[string]string{
+		ZFS_PROPERTY_SHARENFS:    ZFS_PROPERTY_SHARENFS_OFF,
+		ZFS_PROPERTY_READONLY:    ZFS_PROPERTY_ON,
+		ZFS_PROPERTY_PV:          volumeId,
+		ZFS_PROPERTY_NAMESPACE:   properties[ZFS_PROPERTY_NAMESPACE],
+		ZFS_PROPERTY_PVC:         properties[ZFS_PROPERTY_PVC],
+		ZFS_PROPERTY_ARCHIVED_AT: fmt.Sprintf("%d", time.Now().Unix()),
+	}
+	if properties[ZFS_PROPERTY_TYPE] == ZFS_TYPE_VOLUME {
+		delete(archiveProperties, ZFS_PROPERTY_SHARENFS)
+	}
+	return host.Client.CopySnapshot(snapshotName, archiveName, archiveProperties)
+}
+
+// GetCapacity implements csi.ControllerServer.
+func (c *ControllerCsi) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	log.Printf("GetCapacity: %v", req)
+
+	// every storage class can use a different host, so the capacity is reported per host
+	host, err := c.hosts.FromParameters(req.Parameters)
+	if err != nil {
+		return nil, err
+	}
+
+	// the provisioner asks for the capacity of every topology segment, volumes with placement zone or local can only be used from theirs
+	placement, err := placementFromParameters(req.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	blockProtocol, err := blockProtocolFromParameters(req.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	// block volumes that are not exported are placed on the storage node like in CreateVolume
+	if _, ok := req.Parameters[PARAMETER_PLACEMENT]; !ok && blockProtocol == BLOCK_PROTOCOL_LOCAL && isBlockVolume(req.VolumeCapabilities) {
+		placement = PLACEMENT_LOCAL
+	}
+	if req.AccessibleTopology != nil {
+		_, err := volumeTopology(host, placement, &csi.TopologyRequirement{Requisite: []*csi.Topology{req.AccessibleTopology}})
+		if status.Code(err) == codes.ResourceExhausted {
+			res := &csi.GetCapacityResponse{AvailableCapacity: 0, MaximumVolumeSize: wrapperspb.Int64(0), MinimumVolumeSize: wrapperspb.Int64(0)}
+			log.Printf("GetCapacity: %v", res)
+			return res, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	candidates, err := parentDatasetsFromParameters(req.Parameters, host.ParentDataset)
+	if err != nil {
+		return nil, err
+	}
+
+	// parent datasets in the same pool share its space, so it is only counted once per pool
+	poolCapacity := map[string]int64{}
+	maximum := int64(0)
+	for _, candidate := range candidates {
+		available, err := host.Client.GetAvailableSpace(candidate.Dataset)
+		if err != nil {
+			log.Printf("Error getting available space of %s on host %s: %v", candidate.Dataset, host.Name, err)
+			return nil, err
+		}
+
+		capacity := int64(0)
+		if available > host.CapacityReserve {
+			capacity = int64(available - host.CapacityReserve)
+		}
+		pool, _, _ := strings.Cut(candidate.Dataset, "/")
+		poolCapacity[pool] = max(poolCapacity[pool], capacity)
+		maximum = max(maximum, capacity)
+	}
+	total := int64(0)
+	for _, capacity := range poolCapacity {
+		total += capacity
+	}
+
+	// quotas are not reservations, so every volume can use at most the available space of its parent dataset.
+	// there is no minimum volume size, any quota is valid.
+	res := &csi.GetCapacityResponse{
+		AvailableCapacity: total,
+		MaximumVolumeSize: wrapperspb.Int64(maximum),
+		MinimumVolumeSize: wrapperspb.Int64(0),
+	}
+	log.Printf("GetCapacity: %v", res)
+	return res, nil
+}
+
+// ListSnapshots implements csi.ControllerServer.
+func (c *ControllerCsi) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	log.Printf("ListSnapshots: %v", req)
+
+	snapshots := []ZfsSnapshotInfo{}
+	for _, host := range c.hosts {
+		hostSnapshots, err := listCsiSnapshots(host)
+		if err != nil {
+			log.Printf("Error listing snapshots of host %s: %v", host.Name, err)
+			return nil, err
+		}
+		snapshots = append(snapshots, hostSnapshots...)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].properties[ZFS_PROPERTY_SNAPSHOT] < snapshots[j].properties[ZFS_PROPERTY_SNAPSHOT]
+	})
+
+	filtered := []ZfsSnapshotInfo{}
+	for _, snapshot := range snapshots {
+		if req.SnapshotId != "" && snapshot.properties[ZFS_PROPERTY_SNAPSHOT] != req.SnapshotId {
+			continue
+		}
+		if req.SourceVolumeId != "" && snapshot.properties[ZFS_PROPERTY_SNAPSHOT_SOURCE] != req.SourceVolumeId {
+			continue
+		}
+		filtered = append(filtered, snapshot)
+	}
+
+	page, nextToken, err := paginate(filtered, func(s ZfsSnapshotInfo) string {
+		return s.properties[ZFS_PROPERTY_SNAPSHOT]
+	}, req.MaxEntries, req.StartingToken)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*csi.ListSnapshotsResponse_Entry{}
+	for _, snapshot := range page {
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{
+			Snapshot: csiSnapshotFromInfo(&snapshot),
+		})
+	}
+	res := &csi.ListSnapshotsResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}
+	log.Printf("ListSnapshots: %v", res)
+	return res, nil
+}
+
+// ListVolumes implements csi.ControllerServer.
+func (c *ControllerCsi) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	log.Printf("ListVolumes: %v", req)
+
+	datasets := []map[string]string{}
+	for _, host := range c.hosts {
+		parents, err := host.ParentDatasets()
+		if err != nil {
+			log.Printf("Error listing parent datasets of host %s: %v", host.Name, err)
+			return nil, err
+		}
+		hostDatasets, err := host.Client.ListChildDatasetProperties(parents, []string{
+			ZFS_PROPERTY_TYPE,
+			ZFS_PROPERTY_VOLSIZE,
+			ZFS_PROPERTY_QUOTA,
+			ZFS_PROPERTY_REFQUOTA,
+			ZFS_PROPERTY_PV,
+			ZFS_PROPERTY_DELETED,
+			ZFS_PROPERTY_PUBLISHED_NODES,
+		})
+		if err != nil {
+			log.Printf("Error listing datasets of host %s: %v", host.Name, err)
+			return nil, err
+		}
+		datasets = append(datasets, hostDatasets...)
+	}
+
+	entries := []*csi.ListVolumesResponse_Entry{}
+	for _, dataset := range datasets {
+		if dataset[ZFS_PROPERTY_DELETED] != ZFS_PROPERTY_DELETED_FALSE {
+			log.Printf("Dataset is marked as deleted: %s", dataset[ZFS_PROPERTY_NAME])
+			continue
+		}
+		if dataset[ZFS_PROPERTY_PV] == "-" {
+			log.Printf("Dataset is not a volume: %s", dataset[ZFS_PROPERTY_NAME])
+			continue
+		}
+
+		// with -p a quota that is not set is reported as 0
+		capacityProperty := ZFS_PROPERTY_QUOTA
+		if dataset[ZFS_PROPERTY_TYPE] == ZFS_TYPE_VOLUME {
+			capacityProperty = ZFS_PROPERTY_VOLSIZE
+		}
+		capacity, err := strconv.ParseInt(dataset[capacityProperty], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if capacity == 0 && capacityProperty == ZFS_PROPERTY_QUOTA {
+			capacity, err = strconv.ParseInt(dataset[ZFS_PROPERTY_REFQUOTA], 10, 64)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if capacity == 0 {
+			// quota should never be unset since we require it when creating a dataset
+			return nil, status.Errorf(codes.Internal, "dataset quota is not set: %s", dataset[ZFS_PROPERTY_NAME])
+		}
+
+		entries = append(entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				CapacityBytes: capacity,
+				VolumeId:      dataset[ZFS_PROPERTY_PV],
+			},
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				PublishedNodeIds: parsePublishedNodes(dataset[ZFS_PROPERTY_PUBLISHED_NODES]),
+			},
+		})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Volume.VolumeId < entries[j].Volume.VolumeId
+	})
+
+	page, nextToken, err := paginate(entries, func(e *csi.ListVolumesResponse_Entry) string {
+		return e.Volume.VolumeId
+	}, req.MaxEntries, req.StartingToken)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &csi.ListVolumesResponse{
+		Entries:   page,
+		NextToken: nextToken,
+	}
+	log.Printf("ListVolumes: %v", res)
+	return res, nil
+}
+
+// ValidateVolumeCapabilities implements csi.ControllerServer.
+func (c *ControllerCsi) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	log.Printf("ValidateVolumeCapabilities: %v", req)
+
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume id must be specified")
+	}
+	if len(req.VolumeCapabilities) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume capabilities must be specified")
+	}
+
+	// only a volume that doesn't exist is NotFound, errors of the storage host are returned as they are
+	host, dataset, err := c.findVolumeDataset(req.VolumeId)
+	if err != nil {
+		log.Printf("Error finding dataset by volume id: %v", err)
+		return nil, err
+	}
+	datasetType, err := host.Client.GetDatasetType(dataset)
+	if err != nil {
+		log.Printf("Error getting type of dataset %s: %v", dataset, err)
+		return nil, err
+	}
+
+	res := &csi.ValidateVolumeCapabilitiesResponse{}
+	block := isBlockVolume(req.VolumeCapabilities)
+	if err := validateVolumeCapabilities(req.VolumeCapabilities); err != nil {
+		res.Message = err.Error()
+	} else if block && datasetType != ZFS_TYPE_VOLUME {
+		res.Message = "volume is not a block volume"
+	} else if err := validateZvolAccessModes(req.VolumeCapabilities); datasetType == ZFS_TYPE_VOLUME && err != nil {
+		res.Message = err.Error()
+	} else {
+		res.Confirmed = &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.VolumeContext,
+			VolumeCapabilities: req.VolumeCapabilities,
+			Parameters:         req.Parameters,
+		}
+	}
+	log.Printf("ValidateVolumeCapabilities: %v", res)
+	return res, nil
+}
+
+// find the storage host and dataset of the volume with the given id.
+func (c *ControllerCsi) findVolumeDataset(volumeId string) (*StorageHost, string, error) {
+	host, err := c.hosts.FromId(volumeId)
+	if err != nil {
+		return nil, "", err
+	}
+	dataset, err := findExistingDatasetByVolumeId(host.Client, volumeId)
+	if err != nil {
+		return nil, "", err
+	}
+	return host, dataset, nil
+}
+
+// check that every capability is supported by the driver.
+// the returned error describes the first unsupported capability.
+func validateVolumeCapabilities(capabilities []*csi.VolumeCapability) error {
+	block := isBlockVolume(capabilities)
+	for _, capability := range capabilities {
+		if capability.GetBlock() == nil && capability.GetMount() == nil {
+			return fmt.Errorf("volume capability must specify an access type")
+		}
+		if (capability.GetBlock() != nil) != block {
+			return fmt.Errorf("a volume can't be both a block and a filesystem volume")
+		}
+		if capability.AccessMode == nil {
+			return fmt.Errorf("volume capability must specify an access mode")
+		}
+		supported := SUPPORTED_ACCESS_MODES
+		if block {
+			supported = SUPPORTED_BLOCK_ACCESS_MODES
+		}
+		if !slices.Contains(supported, capability.AccessMode.Mode) {
+			return fmt.Errorf("access mode %s is not supported by %s volumes", capability.AccessMode.Mode, volumeMode(block))
+		}
+	}
+	return nil
+}
+
+// check that the capabilities only use the volume from a single node, as required for zvols.
+func validateZvolAccessModes(capabilities []*csi.VolumeCapability) error {
+	for _, capability := range capabilities {
+		if !slices.Contains(SUPPORTED_BLOCK_ACCESS_MODES, capability.AccessMode.GetMode()) {
+			return fmt.Errorf("access mode %s is not supported by zvols", capability.AccessMode.GetMode())
+		}
+	}
+	return nil
+}
+
+// check if the capabilities request a block volume, they must all request the same access type.
+func isBlockVolume(capabilities []*csi.VolumeCapability) bool {
+	return len(capabilities) > 0 && capabilities[0].GetBlock() != nil
+}
+
+func volumeMode(block bool) string {
+	if block {
+		return "block"
+	}
+	return "filesystem"
+}
+
+// grow the zvol to at least size bytes, zvols are never shrunk.
+// returns the resulting size of the zvol.
+func growZvol(client *ZfsClient, dataset string, size uint64) (int64, error) {
+	properties, err := client.GetProperties(dataset, []string{ZFS_PROPERTY_VOLSIZE})
+	if err != nil {
+		return 0, err
+	}
+	current, err := strconv.ParseUint(properties[ZFS_PROPERTY_VOLSIZE], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if current >= size {
+		return int64(current), nil
+	}
+	if err := client.UpdateProperty(dataset, ZFS_PROPERTY_VOLSIZE, fmt.Sprintf("%d", size)); err != nil {
+		return 0, err
+	}
+	return int64(size), nil
+}
+
+// get the topology a volume with the given placement is accessible from.
+// returns a ResourceExhausted error if the requisite topology doesn't include it.
+func volumeTopology(host *StorageHost, placement string, requirements *csi.TopologyRequirement) ([]*csi.Topology, error) {
+	var topology *csi.Topology
+	switch placement {
+	case PLACEMENT_ANY:
+		// accessible from every node, no matter what is requested
+		return nil, nil
+	case PLACEMENT_ZONE:
+		if host.Zone == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "placement %s requires the zone of storage host %s to be set", PLACEMENT_ZONE, host.Name)
+		}
+		topology = &csi.Topology{Segments: map[string]string{TOPOLOGY_KEY_ZONE: host.Zone}}
+	case PLACEMENT_LOCAL:
+		topology = &csi.Topology{Segments: map[string]string{TOPOLOGY_KEY_HOSTNAME: host.Hostname}}
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "invalid placement: %s", placement)
+	}
+
+	if len(requirements.GetRequisite()) > 0 && !slices.ContainsFunc(requirements.GetRequisite(), func(requisite *csi.Topology) bool {
+		return topologyContains(requisite, topology)
+	}) {
+		return nil, status.Errorf(codes.ResourceExhausted, "volume with placement %s is only accessible from %v which is not in the requisite topology", placement, topology.Segments)
+	}
+	return []*csi.Topology{topology}, nil
+}
+
+// check if every segment of the volume topology is present in the node topology.
+func topologyContains(node *csi.Topology, volume *csi.Topology) bool {
+	for key, value := range volume.Segments {
+		if node.Segments[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// pick the parent dataset of the host to create a volume of the given size in.
+// candidates without enough available space are skipped, with none left a ResourceExhausted error is returned.
+func (c *ControllerCsi) selectParentDataset(host *StorageHost, candidates []ParentDatasetCandidate, policy string, size uint64) (string, error) {
+	if len(candidates) == 1 {
+		// nothing to choose from, quotas are not reservations so the volume is created even if it doesn't fit
+		return candidates[0].Dataset, nil
+	}
+
+	available := map[string]uint64{}
+	for _, candidate := range candidates {
+		space, err := host.Client.GetAvailableSpace(candidate.Dataset)
+		if err != nil {
+			log.Printf("Error getting available space of %s: %v", candidate.Dataset, err)
+			return "", err
+		}
+		if space > host.CapacityReserve {
+			available[candidate.Dataset] = space - host.CapacityReserve
+		}
+	}
+
+	index := 0
+	if policy == PARENT_DATASET_POLICY_ROUND_ROBIN {
+		datasets := []string{}
+		for _, candidate := range candidates {
+			datasets = append(datasets, candidate.Dataset)
+		}
+		key := host.Name + ":" + strings.Join(datasets, ",")
+
+		c.roundRobinLock.Lock()
+		if c.roundRobinNext == nil {
+			c.roundRobinNext = map[string]int{}
+		}
+		index = c.roundRobinNext[key]
+		c.roundRobinNext[key] = index + 1
+		c.roundRobinLock.Unlock()
+	}
+
+	dataset, err := pickParentDataset(candidates, available, size, policy, index, rand.Intn)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("selected parent dataset %s with %d bytes available using policy %s", dataset, available[dataset], policy)
+	return dataset, nil
+}
+
+// pick one of the candidates with at least size bytes available.
+// index is the number of volumes created so far with the round robin policy, random is used by the weighted policy.
+func pickParentDataset(candidates []ParentDatasetCandidate, available map[string]uint64, size uint64, policy string, index int, random func(int) int) (string, error) {
+	fitting := []ParentDatasetCandidate{}
+	for _, candidate := range candidates {
+		if available[candidate.Dataset] >= size {
+			fitting = append(fitting, candidate)
+		}
+	}
+	if len(fitting) == 0 {
+		return "", status.Errorf(codes.ResourceExhausted, "no parent dataset has %d bytes available", size)
+	}
+
+	switch policy {
+	case PARENT_DATASET_POLICY_MOST_AVAILABLE:
+		best := fitting[0]
+		for _, candidate := range fitting[1:] {
+			if available[candidate.Dataset] > available[best.Dataset] {
+				best = candidate
+			}
+		}
+		return best.Dataset, nil
+	case PARENT_DATASET_POLICY_ROUND_ROBIN:
+		return fitting[index%len(fitting)].Dataset, nil
+	case PARENT_DATASET_POLICY_WEIGHTED:
+		total := 0
+		for _, candidate := range fitting {
+			total += candidate.Weight
+		}
+		n := random(total)
+		for _, candidate := range fitting {
+			if n < candidate.Weight {
+				return candidate.Dataset, nil
+			}
+			n -= candidate.Weight
+		}
+		return fitting[len(fitting)-1].Dataset, nil
+	default:
+		return "", status.Errorf(codes.InvalidArgument, "invalid %s: %s", PARAMETER_PARENT_DATASET_POLICY, policy)
+	}
+}
+
+// create a new dataset named datasetName with the contents of the volume with the given id.
+// name is the name of the new volume, both volumes must be on the host.
+// a temporary snapshot of the source volume is used as the origin of the new dataset,
+// it is marked as released once the restore is done so it gets destroyed once it no longer has dependent clones.
+// releasing it earlier would let a concurrent destroyReleasedSnapshots destroy it before it has a clone.
+func cloneVolume(host *StorageHost, sourceVolumeId, name, datasetName string, properties map[string]string, mode string) error {
+	volumeId := host.Id(name)
+	sourceDataset, err := findExistingDatasetByVolumeId(host.Client, sourceVolumeId)
+	if err != nil {
+		log.Printf("Error finding dataset by volume id: %v", err)
+		return status.Errorf(codes.NotFound, "source volume not found: %s", sourceVolumeId)
+	}
+
+	snapshot, err := findCloneSnapshot(host, volumeId)
+	if err != nil {
+		log.Printf("Error finding clone snapshot: %v", err)
+		return err
+	}
+
+	snapshotName := ""
+	if snapshot != nil {
+		log.Printf("found an existing clone snapshot: %s", snapshot.name)
+		snapshotName = snapshot.name
+	} else {
+		snapshotName = fmt.Sprintf("%s@clone-%s", sourceDataset, name)
+		if err := host.Client.CreateSnapshot(snapshotName, map[string]string{
+			ZFS_PROPERTY_CLONE_TARGET: volumeId,
+		}); err != nil {
+			return err
+		}
+	}
+
+	restoreErr := restoreSnapshot(host, snapshotName, datasetName, properties, mode)
+	// promote moves the snapshot to the new dataset, so it is looked up again
+	snapshot, err = findCloneSnapshot(host, volumeId)
+	if err == nil && snapshot != nil {
+		err = host.Client.UpdateProperty(snapshot.name, ZFS_PROPERTY_RELEASED, ZFS_PROPERTY_RELEASED_TRUE)
+	}
+	if err != nil {
+		log.Printf("Error releasing clone snapshot: %v", err)
+		if restoreErr == nil {
+			return err
+		}
+	}
+	// if the restore failed or did not create a clone the temporary snapshot is no longer needed
+	if err := destroyReleasedSnapshots(host); err != nil {
+		log.Printf("Error destroying released snapshots: %v", err)
+	}
+	return restoreErr
+}
+
+// create a new dataset with the contents of the snapshot.
+func restoreSnapshot(host *StorageHost, snapshot, datasetName string, properties map[string]string, mode string) error {
+	log.Printf("restoring snapshot %s to %s using mode %s", snapshot, datasetName, mode)
+	switch mode {
+	case SNAPSHOT_RESTORE_MODE_CLONE:
+		return host.Client.CloneSnapshot(snapshot, datasetName, properties)
+	case SNAPSHOT_RESTORE_MODE_PROMOTE:
+		// this inverts the dependency, the snapshot and the older ones move to the new dataset and the source becomes its clone
+		if err := host.Client.CloneSnapshot(snapshot, datasetName, properties); err != nil {
+			return err
+		}
+		return host.Client.PromoteDataset(datasetName)
+	case SNAPSHOT_RESTORE_MODE_COPY:
+		if err := host.Client.CopySnapshot(snapshot, datasetName, properties); err != nil {
+			return err
+		}
+		// zfs recv also creates the snapshot on the new dataset, we don't need it
+		_, snapshotName, _ := strings.Cut(snapshot, "@")
+		return host.Client.DestroySnapshot(fmt.Sprintf("%s@%s", datasetName, snapshotName))
+	default:
+		return status.Errorf(codes.InvalidArgument, "invalid %s: %s", PARAMETER_SNAPSHOT_RESTORE_MODE, mode)
+	}
+}
+
+// check the health of the volume's dataset and the nodes it is published to, and fill in its capacity.
+// errors talking to the storage host are returned, problems with the volume itself are reported in the condition.
+func (c *ControllerCsi) getVolumeStatus(volume *csi.Volume) (*csi.ControllerGetVolumeResponse_VolumeStatus, error) {
+	host, err := c.hosts.FromId(volume.VolumeId)
+	if err != nil {
+		return nil, err
+	}
+
+	dataset, err := host.Client.FindDatasetByProperties(map[string]string{
+		ZFS_PROPERTY_PV:      volume.VolumeId,
+		ZFS_PROPERTY_DELETED: ZFS_PROPERTY_DELETED_FALSE,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if dataset == "" {
+		deleted, err := host.Client.FindDatasetByProperties(map[string]string{
+			ZFS_PROPERTY_PV: volume.VolumeId,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if deleted != "" {
+			return abnormalVolumeStatus(fmt.Sprintf("dataset %s is marked as deleted", deleted)), nil
+		}
+		return abnormalVolumeStatus("dataset not found"), nil
+	}
+
+	properties, err := host.Client.GetProperties(dataset, []string{ZFS_PROPERTY_TYPE, ZFS_PROPERTY_VOLSIZE, ZFS_PROPERTY_QUOTA, ZFS_PROPERTY_USED, ZFS_PROPERTY_REFQUOTA, ZFS_PROPERTY_REFERENCED, ZFS_PROPERTY_SHARENFS, ZFS_PROPERTY_PUBLISHED_NODES})
+	if err != nil {
+		log.Printf("Error getting properties of dataset %s: %v", dataset, err)
+		return nil, err
+	}
+
+	problems := []string{}
+	zvol := properties[ZFS_PROPERTY_TYPE] == ZFS_TYPE_VOLUME
+
+	if zvol {
+		// a zvol can't run out of space before its volsize, unless the pool does
+		volsize, err := strconv.ParseInt(properties[ZFS_PROPERTY_VOLSIZE], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		volume.CapacityBytes = volsize
+	} else {
+		// with a refquota only the referenced space counts towards the size of the volume
+		quotaProperty, usedProperty := ZFS_PROPERTY_QUOTA, ZFS_PROPERTY_USED
+		if properties[ZFS_PROPERTY_REFQUOTA] != "0" {
+			quotaProperty, usedProperty = ZFS_PROPERTY_REFQUOTA, ZFS_PROPERTY_REFERENCED
+		}
+		quota, err := strconv.ParseInt(properties[quotaProperty], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		used, err := strconv.ParseInt(properties[usedProperty], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		volume.CapacityBytes = quota
+		if quota > 0 && used >= quota {
+			problems = append(problems, fmt.Sprintf("quota exceeded, %d of %d bytes used", used, quota))
+		}
+	}
+
+	publishedNodes := parsePublishedNodes(properties[ZFS_PROPERTY_PUBLISHED_NODES])
+	if !zvol && len(publishedNodes) > 0 && properties[ZFS_PROPERTY_SHARENFS] == ZFS_PROPERTY_SHARENFS_OFF {
+		problems = append(problems, "dataset is published but not shared over nfs")
+	}
+
+	pool, _, _ := strings.Cut(dataset, "/")
+	health, err := host.Client.GetPoolHealth(pool)
+	if err != nil {
+		log.Printf("Error getting health of pool %s: %v", pool, err)
+		return nil, err
+	}
+	if health != ZPOOL_HEALTH_ONLINE {
+		problems = append(problems, fmt.Sprintf("pool %s is %s", pool, health))
+	}
+
+	volumeStatus := &csi.ControllerGetVolumeResponse_VolumeStatus{
+		PublishedNodeIds: publishedNodes,
+		VolumeCondition:  &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"},
+	}
+	if len(problems) > 0 {
+		volumeStatus.VolumeCondition = &csi.VolumeCondition{Abnormal: true, Message: strings.Join(problems, "; ")}
+	}
+	return volumeStatus, nil
+}
+
+func abnormalVolumeStatus(message string) *csi.ControllerGetVolumeResponse_VolumeStatus {
+	return &csi.ControllerGetVolumeResponse_VolumeStatus{
+		VolumeCondition: &csi.VolumeCondition{Abnormal: true, Message: message},
+	}
+}
+
+func csiSnapshotFromInfo(snapshot *ZfsSnapshotInfo) *csi.Snapshot {
+	return &csi.Snapshot{
+		SizeBytes:      int64(snapshot.referenced),
+		SnapshotId:     snapshot.properties[ZFS_PROPERTY_SNAPSHOT],
+		SourceVolumeId: snapshot.properties[ZFS_PROPERTY_SNAPSHOT_SOURCE],
+		CreationTime:   timestamppb.New(time.Unix(snapshot.creation, 0)),
+		ReadyToUse:     true,
+	}
 }
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestValidateVolumeCapabilities(t *testing.T) {
+	mount := func(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		}
+	}
+
+	for _, mode := range SUPPORTED_ACCESS_MODES {
+		if err := validateVolumeCapabilities([]*csi.VolumeCapability{mount(mode)}); err != nil {
+			t.Errorf("unexpected error for %s: %v", mode, err)
+		}
+	}
+
+	if err := validateVolumeCapabilities([]*csi.VolumeCapability{mount(csi.VolumeCapability_AccessMode_UNKNOWN)}); err == nil {
+		t.Errorf("expected an error for an unknown access mode")
+	}
+
+	block := func(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		}
+	}
+	for _, mode := range SUPPORTED_BLOCK_ACCESS_MODES {
+		if err := validateVolumeCapabilities([]*csi.VolumeCapability{block(mode)}); err != nil {
+			t.Errorf("unexpected error for block %s: %v", mode, err)
+		}
+	}
+	if err := validateVolumeCapabilities([]*csi.VolumeCapability{block(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)}); err == nil {
+		t.Errorf("expected an error for a block volume on multiple nodes")
+	}
+	if err := validateZvolAccessModes([]*csi.VolumeCapability{mount(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)}); err == nil {
+		t.Errorf("expected an error for a zvol on multiple nodes")
+	}
+	if err := validateZvolAccessModes([]*csi.VolumeCapability{mount(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)}); err != nil {
+		t.Errorf("unexpected error for a zvol on a single node: %v", err)
+	}
+	mixed := []*csi.VolumeCapability{block(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER), mount(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)}
+	if err := validateVolumeCapabilities(mixed); err == nil {
+		t.Errorf("expected an error for mixed block and filesystem capabilities")
+	}
+
+	if err := validateVolumeCapabilities([]*csi.VolumeCapability{{}}); err == nil {
+		t.Errorf("expected an error for a capability without access type")
+	}
+}
+
+func TestVolumeTopology(t *testing.T) {
+	host := &StorageHost{Name: "citadel", Hostname: "citadel", Zone: "home"}
+	requisite := func(segments ...map[string]string) *csi.TopologyRequirement {
+		requirement := &csi.TopologyRequirement{}
+		for _, s := range segments {
+			requirement.Requisite = append(requirement.Requisite, &csi.Topology{Segments: s})
+		}
+		return requirement
+	}
+
+	topology, err := volumeTopology(host, PLACEMENT_ANY, requisite(map[string]string{TOPOLOGY_KEY_HOSTNAME: "other"}))
+	if err != nil || topology != nil {
+		t.Errorf("expected no topology for placement any, got %v %v", topology, err)
+	}
+
+	topology, err = volumeTopology(host, PLACEMENT_LOCAL, requisite(
+		map[string]string{TOPOLOGY_KEY_HOSTNAME: "other", TOPOLOGY_KEY_ZONE: "home"},
+		map[string]string{TOPOLOGY_KEY_HOSTNAME: "citadel", TOPOLOGY_KEY_ZONE: "home"},
+	))
+	if err != nil || len(topology) != 1 || topology[0].Segments[TOPOLOGY_KEY_HOSTNAME] != "citadel" {
+		t.Errorf("expected the storage host topology, got %v %v", topology, err)
+	}
+
+	if _, err := volumeTopology(host, PLACEMENT_LOCAL, requisite(map[string]string{TOPOLOGY_KEY_HOSTNAME: "other"})); err == nil {
+		t.Errorf("expected an error when the storage host is not in the requisite topology")
+	}
+
+	topology, err = volumeTopology(host, PLACEMENT_ZONE, nil)
+	if err != nil || len(topology) != 1 || topology[0].Segments[TOPOLOGY_KEY_ZONE] != "home" {
+		t.Errorf("expected the storage zone topology, got %v %v", topology, err)
+	}
+
+	host.Zone = ""
+	if _, err := volumeTopology(host, PLACEMENT_ZONE, nil); err == nil {
+		t.Errorf("expected an error when the storage zone is not configured")
+	}
+}
+
+func TestPickParentDataset(t *testing.T) {
+	candidates := []ParentDatasetCandidate{{"a/csi", 1}, {"b/csi", 3}, {"c/csi", 1}}
+	available := map[string]uint64{"a/csi": 100, "b/csi": 50, "c/csi": 10}
+	random := func(n int) int { return n - 1 }
+
+	if dataset, err := pickParentDataset(candidates, available, 20, PARENT_DATASET_POLICY_MOST_AVAILABLE, 0, random); err != nil || dataset != "a/csi" {
+		t.Errorf("expected the dataset with the most available space, got %v %v", dataset, err)
+	}
+
+	picked := []string{}
+	for i := 0; i < 3; i++ {
+		dataset, err := pickParentDataset(candidates, available, 20, PARENT_DATASET_POLICY_ROUND_ROBIN, i, random)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		picked = append(picked, dataset)
+	}
+	if picked[0] != "a/csi" || picked[1] != "b/csi" || picked[2] != "a/csi" {
+		t.Errorf("expected round robin over the datasets with enough space, got %v", picked)
+	}
+
+	if dataset, err := pickParentDataset(candidates, available, 5, PARENT_DATASET_POLICY_WEIGHTED, 0, func(int) int { return 1 }); err != nil || dataset != "b/csi" {
+		t.Errorf("expected the weighted dataset, got %v %v", dataset, err)
+	}
+
+	if _, err := pickParentDataset(candidates, available, 200, PARENT_DATASET_POLICY_MOST_AVAILABLE, 0, random); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected ResourceExhausted when no dataset has enough space, got %v", err)
+	}
+}
+
+func TestPublishedNodesRoundTrip(t *testing.T) {
+	get := "zfs get -H -p -o property,value k8s:published-nodes,sharenfs,type pool/csi/pvc-1"
+	executor := &fakeExecutor{outputs: map[string]string{
+		get: "k8s:published-nodes\tnode1\nsharenfs\trw=@10.0.0.1/32\ntype\tfilesystem\n",
+	}}
+	host := &StorageHost{Name: "citadel", Client: &ZfsClient{executor: executor}}
+	c := &ControllerCsi{config: &ControllerConfig{NfsNodeAddresses: map[string]string{"node1": "10.0.0.1"}}}
+
+	if err := c.updatePublishedNodes(host, "pool/csi/pvc-1", func([]string) ([]string, error) { return []string{}, nil }); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{get, "zfs set sharenfs=off pool/csi/pvc-1", "zfs inherit k8s:published-nodes pool/csi/pvc-1"}
+	if !slices.Equal(executor.commands, expected) {
+		t.Errorf("expected commands %v, got %v", expected, executor.commands)
+	}
+
+	// an empty value of a volume unpublished before the property was removed is the last field of the output
+	executor.outputs[get] = "type\tfilesystem\nsharenfs\toff\nk8s:published-nodes\t\n"
+	properties, err := host.Client.GetProperties("pool/csi/pvc-1", []string{ZFS_PROPERTY_PUBLISHED_NODES, ZFS_PROPERTY_SHARENFS, ZFS_PROPERTY_TYPE})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if nodes := parsePublishedNodes(properties[ZFS_PROPERTY_PUBLISHED_NODES]); len(nodes) != 0 {
+		t.Errorf("expected no published nodes, got %v", nodes)
+	}
+}
+
+func TestRestoreNvmeofExports(t *testing.T) {
+	list := "zfs list -H -p -d 1 -t filesystem,volume -o name,k8s:pv,type,k8s:block-protocol,k8s:published-nodes pool/csi"
+	executor := &fakeExecutor{outputs: map[string]string{
+		list: "pool/csi\t-\tfilesystem\t-\t-\n" +
+			"pool/csi/pvc-1\tcitadel/pvc-1\tvolume\tnvmeof\tworker1,citadel\n" +
+			"pool/csi/pvc-2\tcitadel/pvc-2\tvolume\tiscsi\tworker1\n" +
+			"pool/csi/pvc-3\tcitadel/pvc-3\tfilesystem\t-\tworker1\n",
+	}}
+	host := &StorageHost{Name: "citadel", Hostname: "citadel", ParentDataset: "pool/csi", Client: &ZfsClient{executor: executor}}
+
+	if err := restoreNvmeofExports(host); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	subsystem := NVMET_CONFIGFS + "/subsystems/" + nvmeofSubsystemNqn("citadel/pvc-1")
+	hostNqn := nvmeofHostNqn("worker1")
+	// only the nvme-of zvol is exported again, and not to the storage node which uses it directly
+	for _, command := range executor.commands {
+		if strings.HasPrefix(command, "targetcli") || strings.Contains(command, "node.citadel") {
+			t.Errorf("unexpected command %s", command)
+		}
+	}
+	link := "ln -s " + NVMET_CONFIGFS + "/hosts/" + hostNqn + " " + subsystem + "/allowed_hosts/" + hostNqn
+	if !slices.Contains(executor.commands, link) {
+		t.Errorf("expected worker1 to be allowed again, got %v", executor.commands)
+	}
+}
+
+func TestPublishedNodesUnresolvable(t *testing.T) {
+	get := "zfs get -H -p -o property,value k8s:published-nodes,sharenfs,type pool/csi/pvc-1"
+	// a node id that is not a valid host name fails to resolve without asking dns
+	gone := "gone node"
+	executor := &fakeExecutor{outputs: map[string]string{
+		get: "k8s:published-nodes\t" + gone + "\nsharenfs\trw=@10.0.0.2/32\ntype\tfilesystem\n",
+	}}
+	host := &StorageHost{Name: "citadel", Client: &ZfsClient{executor: executor}}
+	c := &ControllerCsi{config: &ControllerConfig{NfsNodeAddresses: map[string]string{"node1": "10.0.0.1"}}}
+
+	// the node that can't be resolved anymore doesn't keep another node from being published
+	if err := c.updatePublishedNodes(host, "pool/csi/pvc-1", func(nodes []string) ([]string, error) { return append(nodes, "node1"), nil }); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Contains(executor.commands, "zfs set sharenfs=rw=@10.0.0.1/32 pool/csi/pvc-1") {
+		t.Errorf("expected the export to be updated, got %v", executor.commands)
+	}
+
+	// a new node that can't be resolved is still an error
+	if err := c.updatePublishedNodes(host, "pool/csi/pvc-1", func(nodes []string) ([]string, error) { return []string{"other node"}, nil }); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected failed precondition for a new unresolvable node, got %v", err)
+	}
+}
+
+func TestPublishSingleNodeVolume(t *testing.T) {
+	executor := &fakeExecutor{outputs: map[string]string{
+		"zfs list -H -t filesystem,volume -o name,k8s:deleted,k8s:pv":                                    "pool/csi/pvc-1\tfalse\tcitadel/pvc-1\n",
+		"zfs get -H -p -o property,value type,keystatus,keyformat,encryptionroot,mounted pool/csi/pvc-1": "type\tfilesystem\nkeystatus\t-\nkeyformat\tnone\nencryptionroot\t-\nmounted\tyes\n",
+		"zfs get -H -p -o property,value k8s:published-nodes,sharenfs,type pool/csi/pvc-1":               "k8s:published-nodes\tworker1\nsharenfs\trw=@10.0.0.1/32\ntype\tfilesystem\n",
+		"zfs get -H -p -o property,value type,k8s:block-protocol,k8s:published-nodes pool/csi/pvc-1":     "type\tfilesystem\nk8s:block-protocol\t-\nk8s:published-nodes\tworker1,worker2\n",
+	}}
+	c := &ControllerCsi{
+		config: &ControllerConfig{NfsNodeAddresses: map[string]string{"worker1": "10.0.0.1", "worker2": "10.0.0.2"}},
+		hosts:  StorageHosts{{Name: "citadel", Client: &ZfsClient{executor: executor}}},
+	}
+	publish := func(mode csi.VolumeCapability_AccessMode_Mode) error {
+		_, err := c.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+			VolumeId:         "citadel/pvc-1",
+			NodeId:           "worker2",
+			VolumeCapability: &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode}},
+		})
+		return err
+	}
+
+	if err := publish(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected failed precondition for a second node of a single node volume, got %v", err)
+	}
+	if slices.Contains(executor.commands, "zfs set sharenfs=rw=@10.0.0.1/32:@10.0.0.2/32 pool/csi/pvc-1") {
+		t.Errorf("expected the export to be unchanged")
+	}
+	if err := publish(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER); err != nil {
+		t.Errorf("unexpected error for a multi node volume: %v", err)
+	}
+	if !slices.Contains(executor.commands, "zfs set sharenfs=rw=@10.0.0.1/32:@10.0.0.2/32 pool/csi/pvc-1") {
+		t.Errorf("expected the volume to be exported to both nodes, got %v", executor.commands)
+	}
+}
+
+func TestUnpublishVolume(t *testing.T) {
+	list := "zfs list -H -t filesystem,volume -o name,k8s:deleted,k8s:pv"
+	executor := &fakeExecutor{outputs: map[string]string{list: "pool/csi/pvc-2\tfalse\tcitadel/pvc-2\n"}, errors: map[string]error{}}
+	c := &ControllerCsi{hosts: StorageHosts{{Name: "citadel", Client: &ZfsClient{executor: executor}}}}
+	unpublish := func(volumeId string) error {
+		_, err := c.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeId, NodeId: "worker1"})
+		return err
+	}
+
+	if err := unpublish("citadel/pvc-1"); err != nil {
+		t.Errorf("expected a volume that is gone to be unpublished, got %v", err)
+	}
+	if err := unpublish("gone/pvc-1"); err == nil {
+		t.Errorf("expected an error for an unknown storage host")
+	}
+	// the node still has access to the volume, so the attacher has to retry
+	executor.errors[list] = errors.New("connection lost")
+	if err := unpublish("citadel/pvc-1"); err == nil {
+		t.Errorf("expected the error listing the datasets")
+	}
+}
+
+func TestCloneVolumeReleasesSnapshotAfterRestore(t *testing.T) {
+	volumes := "zfs list -H -t filesystem,volume -o name,k8s:deleted,k8s:pv"
+	cloneSnapshots := "zfs list -H -p -r -t snapshot -o name,creation,referenced,k8s:clone-target pool/csi"
+	release := "zfs set k8s:released=true pool/csi/pvc-1@clone-pvc-2"
+	clone := "zfs clone pool/csi/pvc-1@clone-pvc-2 pool/csi/pvc-2"
+
+	executor := &fakeExecutor{outputs: map[string]string{volumes: "pool/csi/pvc-1\tfalse\tcitadel/pvc-1\n"}}
+	host := &StorageHost{Name: "citadel", ParentDataset: "pool/csi", Client: &ZfsClient{executor: executor}}
+	if err := cloneVolume(host, "citadel/pvc-1", "pvc-2", "pool/csi/pvc-2", map[string]string{}, SNAPSHOT_RESTORE_MODE_CLONE); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// a released snapshot could be destroyed by another volume before it is cloned
+	if !slices.Contains(executor.commands, "zfs snapshot -o k8s:clone-target=citadel/pvc-2 pool/csi/pvc-1@clone-pvc-2") {
+		t.Errorf("expected the snapshot to be created without being released, got %v", executor.commands)
+	}
+
+	executor = &fakeExecutor{outputs: map[string]string{
+		volumes:        "pool/csi/pvc-1\tfalse\tcitadel/pvc-1\n",
+		cloneSnapshots: "pool/csi/pvc-1@clone-pvc-2\t1700000000\t1024\tcitadel/pvc-2\n",
+	}}
+	host.Client = &ZfsClient{executor: executor}
+	if err := cloneVolume(host, "citadel/pvc-1", "pvc-2", "pool/csi/pvc-2", map[string]string{}, SNAPSHOT_RESTORE_MODE_CLONE); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cloned, released := slices.Index(executor.commands, clone), slices.Index(executor.commands, release)
+	if cloned == -1 || released < cloned {
+		t.Errorf("expected the snapshot to be released after it was cloned, got %v", executor.commands)
+	}
+}
+
+func TestLoadVolumeKeyOfClone(t *testing.T) {
+	executor := &fakeExecutor{outputs: map[string]string{
+		"zfs get -H -p -o property,value type,keystatus,keyformat,encryptionroot,mounted pool/csi/pvc-2": "type\tfilesystem\nkeystatus\tunavailable\nkeyformat\tpassphrase\nencryptionroot\tpool/csi/pvc-1\nmounted\tno\n",
+	}}
+	host := &StorageHost{Name: "citadel", Client: &ZfsClient{executor: executor}}
+	if err := loadVolumeKey(host, "pool/csi/pvc-2", map[string]string{SECRET_ENCRYPTION_KEY: "correct horse"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the clone shares the encryption root of its origin, the source volume may not be published or even exist
+	load := slices.Index(executor.commands, "zfs load-key pool/csi/pvc-1")
+	if load == -1 || executor.stdins[load] != "correct horse" {
+		t.Errorf("expected the key of the encryption root to be loaded, got %v", executor.commands)
+	}
+	if !slices.Contains(executor.commands, "zfs mount pool/csi/pvc-2") {
+		t.Errorf("expected the clone to be mounted, got %v", executor.commands)
+	}
+}
+
+func TestCreateVolumeFromEncryptedSnapshot(t *testing.T) {
+	executor := &fakeExecutor{outputs: map[string]string{
+		"zfs list -H -t filesystem,volume -o name,k8s:deleted,k8s:namespace,k8s:pvc":                                              "pool/csi\t-\t-\t-\n",
+		"zfs list -H -p -r -t snapshot -o name,creation,referenced,k8s:snapshot,k8s:snapshot-source,k8s:released,clones pool/csi": "pool/csi/pvc-1@snap-1\t1700000000\t1024\tcitadel/snap-1\tcitadel/pvc-1\t-\t\n",
+		"zfs get -H -o value type pool/csi/pvc-1":                                                                                 "filesystem\n",
+		"zfs list -H -o name,mountpoint,quota,refquota":                                                                           "pool/csi/pvc-1\t/pool/csi/pvc-1\t0\t0\npool/csi/default-data\t/pool/csi/default-data\t0\t0\n",
+		"zfs get -H -p -o property,value encryptionroot pool/csi/pvc-1@snap-1":                                                    "encryptionroot\tpool/csi/pvc-1\n",
+		// a raw zfs recv creates the dataset without loading its key
+		"zfs get -H -p -o property,value type,keystatus,keyformat,encryptionroot,mounted pool/csi/default-data": "type\tfilesystem\nkeystatus\tunavailable\nkeyformat\tpassphrase\nencryptionroot\tpool/csi/default-data\nmounted\tno\n",
+	}}
+	c := &ControllerCsi{hosts: StorageHosts{{Name: "citadel", ParentDataset: "pool/csi", Client: &ZfsClient{executor: executor}}}}
+	_, err := c.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name: "pvc-2",
+		Parameters: map[string]string{
+			"csi.storage.k8s.io/pvc/namespace": "default",
+			"csi.storage.k8s.io/pvc/name":      "data",
+			PARAMETER_SNAPSHOT_RESTORE_MODE:    SNAPSHOT_RESTORE_MODE_COPY,
+		},
+		Secrets:       map[string]string{SECRET_ENCRYPTION_KEY: "correct horse"},
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 30},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+		VolumeContentSource: &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "citadel/snap-1"},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	mount, chmod := slices.Index(executor.commands, "zfs mount pool/csi/default-data"), -1
+	for i, command := range executor.commands {
+		if strings.HasPrefix(command, "chmod ") {
+			chmod = i
+		}
+	}
+	if load := slices.Index(executor.commands, "zfs load-key pool/csi/default-data"); load == -1 || executor.stdins[load] != "correct horse" {
+		t.Errorf("expected the key of the copy to be loaded, got %v", executor.commands)
+	}
+	if mount == -1 || chmod < mount {
+		t.Errorf("expected the copy to be mounted before its mountpoint is changed, got %v", executor.commands)
+	}
+}
+
+func TestModifyVolumeLookupErrors(t *testing.T) {
+	list := "zfs list -H -t filesystem,volume -o name,k8s:deleted,k8s:pv"
+	executor := &fakeExecutor{outputs: map[string]string{list: "pool/csi/pvc-2\tfalse\tcitadel/pvc-2\n"}, errors: map[string]error{}}
+	c := &ControllerCsi{hosts: StorageHosts{{Name: "citadel", Client: &ZfsClient{executor: executor}}}}
+	modify := func() error {
+		_, err := c.ControllerModifyVolume(context.Background(), &csi.ControllerModifyVolumeRequest{VolumeId: "citadel/pvc-1"})
+		return err
+	}
+
+	if err := modify(); status.Code(err) != codes.NotFound {
+		t.Errorf("expected not found for a volume that doesn't exist, got %v", err)
+	}
+	// the resizer gives up on not found, so errors of the storage host must not be reported as one
+	executor.errors[list] = errors.New("connection lost")
+	if err := modify(); err == nil || status.Code(err) == codes.NotFound {
+		t.Errorf("expected the error listing the datasets, got %v", err)
+	}
+}
+
+func TestValidateVolumeCapabilitiesLookupErrors(t *testing.T) {
+	list := "zfs list -H -t filesystem,volume -o name,k8s:deleted,k8s:pv"
+	executor := &fakeExecutor{outputs: map[string]string{list: "pool/csi/pvc-2\tfalse\tcitadel/pvc-2\n"}, errors: map[string]error{}}
+	c := &ControllerCsi{hosts: StorageHosts{{Name: "citadel", Client: &ZfsClient{executor: executor}}}}
+	validate := func() error {
+		_, err := c.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+			VolumeId: "citadel/pvc-1",
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+		})
+		return err
+	}
+
+	if err := validate(); status.Code(err) != codes.NotFound {
+		t.Errorf("expected not found for a volume that doesn't exist, got %v", err)
+	}
+	executor.errors[list] = errors.New("connection lost")
+	if err := validate(); err == nil || status.Code(err) == codes.NotFound {
+		t.Errorf("expected the error listing the datasets, got %v", err)
+	}
+}
+
+func TestGetCapacityTopology(t *testing.T) {
+	executor := &fakeExecutor{outputs: map[string]string{"zfs get -H -p -o value available pool/csi": "1073741824\n"}}
+	c := &ControllerCsi{hosts: StorageHosts{{Name: "citadel", Hostname: "citadel", Zone: "home", ParentDataset: "pool/csi", Client: &ZfsClient{executor: executor}}}}
+	capacity := func(placement, hostname, zone string) int64 {
+		res, err := c.GetCapacity(context.Background(), &csi.GetCapacityRequest{
+			Parameters:         map[string]string{PARAMETER_PLACEMENT: placement},
+			AccessibleTopology: &csi.Topology{Segments: map[string]string{TOPOLOGY_KEY_HOSTNAME: hostname, TOPOLOGY_KEY_ZONE: zone}},
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return res.AvailableCapacity
+	}
+
+	for _, test := range []struct {
+		placement, hostname, zone string
+		expected                  int64
+	}{
+		{PLACEMENT_ANY, "worker1", "work", 1073741824},
+		{PLACEMENT_ZONE, "worker1", "home", 1073741824},
+		{PLACEMENT_ZONE, "worker1", "work", 0},
+		{PLACEMENT_LOCAL, "citadel", "home", 1073741824},
+		{PLACEMENT_LOCAL, "worker1", "home", 0},
+	} {
+		if v := capacity(test.placement, test.hostname, test.zone); v != test.expected {
+			t.Errorf("expected capacity %d with placement %s on %s in %s, got %d", test.expected, test.placement, test.hostname, test.zone, v)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	gcRuns              = expvar.NewInt("gc_runs")
+	gcErrors            = expvar.NewInt("gc_errors")
+	gcDestroyedDatasets = expvar.NewInt("gc_destroyed_datasets")
+	gcReclaimedBytes    = expvar.NewInt("gc_reclaimed_bytes")
+	// datasets that have expired but were kept, because of dry run or because they are still in use
+	gcKeptDatasets = expvar.NewInt("gc_kept_datasets")
+)
+
+type GarbageCollectorConfig struct {
+	Interval time.Duration
+	// retention of datasets without a retention of their own, nil keeps them forever
+	Retention *time.Duration
+	DryRun    bool
+}
+
+// destroys the datasets of deleted volumes once their retention period is over
+type GarbageCollector struct {
+	config *GarbageCollectorConfig
+	hosts  StorageHosts
+}
+
+// collect garbage every interval, never returns.
+func (g *GarbageCollector) Run() {
+	log.Printf("Starting garbage collector, interval: %s, retention: %v, dry run: %v", g.config.Interval, formatRetention(g.config.Retention), g.config.DryRun)
+	for {
+		g.Collect()
+		time.Sleep(g.config.Interval)
+	}
+}
+
+func (g *GarbageCollector) Collect() {
+	gcRuns.Add(1)
+	for _, host := range g.hosts {
+		if err := g.collectHost(host); err != nil {
+			gcErrors.Add(1)
+			log.Printf("Error collecting garbage on host %s: %v", host.Name, err)
+		}
+	}
+}
+
+func (g *GarbageCollector) collectHost(host *StorageHost) error {
+	parents, err := host.ParentDatasets()
+	if err != nil {
+		return err
+	}
+	datasets, err := host.Client.ListChildDatasetProperties(parents, []string{
+		ZFS_PROPERTY_DELETED,
+		ZFS_PROPERTY_DELETED_AT,
+		ZFS_PROPERTY_DELETED_RETENTION,
+		ZFS_PROPERTY_USED,
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	destroyed := false
+	for _, dataset := range datasets {
+		name := dataset[ZFS_PROPERTY_NAME]
+		if dataset[ZFS_PROPERTY_DELETED] != ZFS_PROPERTY_DELETED_TRUE {
+			continue
+		}
+
+		expired, err := deletedDatasetExpired(dataset, g.config.Retention, now)
+		if err != nil {
+			gcErrors.Add(1)
+			log.Printf("Error checking if dataset %s expired: %v", name, err)
+			continue
+		}
+		if !expired {
+			continue
+		}
+
+		inUse, err := deletedDatasetInUse(host.Client, name)
+		if err != nil {
+			gcErrors.Add(1)
+			log.Printf("Error checking if dataset %s is in use: %v", name, err)
+			continue
+		}
+		if inUse != "" {
+			gcKeptDatasets.Add(1)
+			log.Printf("Keeping expired dataset %s: %s", name, inUse)
+			continue
+		}
+
+		used, _ := strconv.ParseInt(dataset[ZFS_PROPERTY_USED], 10, 64)
+		if g.config.DryRun {
+			gcKeptDatasets.Add(1)
+			log.Printf("Dry run, would destroy expired dataset %s reclaiming %d bytes", name, used)
+			continue
+		}
+
+		log.Printf("Destroying expired dataset %s reclaiming %d bytes", name, used)
+		if err := host.Client.DestroyDataset(name); err != nil {
+			gcErrors.Add(1)
+			continue
+		}
+		gcDestroyedDatasets.Add(1)
+		gcReclaimedBytes.Add(used)
+		destroyed = true
+	}
+
+	if destroyed {
+		// the destroyed datasets could have been the last clones of released snapshots
+		if err := destroyReleasedSnapshots(host); err != nil {
+			log.Printf("Error destroying released snapshots: %v", err)
+		}
+	}
+	return nil
+}
+
+// check if the retention period of the deleted dataset is over.
+// the dataset must have been listed with the deleted-at and deleted-retention properties.
+func deletedDatasetExpired(dataset map[string]string, defaultRetention *time.Duration, now time.Time) (bool, error) {
+	retention := defaultRetention
+	if value := dataset[ZFS_PROPERTY_DELETED_RETENTION]; value != "" && value != "-" {
+		r, err := parseRetention(value)
+		if err != nil {
+			return false, err
+		}
+		retention = r
+	}
+	if retention == nil {
+		return false, nil
+	}
+
+	deletedAt, err := datasetDeletedAt(dataset)
+	if err != nil {
+		return false, err
+	}
+	return now.Sub(deletedAt) >= *retention, nil
+}
+
+// get when the volume of the dataset was deleted.
+// datasets deleted before deleted-at existed use the timestamp appended to their name.
+func datasetDeletedAt(dataset map[string]string) (time.Time, error) {
+	deletedAt := dataset[ZFS_PROPERTY_DELETED_AT]
+	if deletedAt == "" || deletedAt == "-" {
+		index := strings.LastIndex(dataset[ZFS_PROPERTY_NAME], "-")
+		if index == -1 {
+			return time.Time{}, fmt.Errorf("unknown deletion time")
+		}
+		deletedAt = dataset[ZFS_PROPERTY_NAME][index+1:]
+	}
+	timestamp, err := strconv.ParseInt(deletedAt, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid deletion time '%s'", deletedAt)
+	}
+	return time.Unix(timestamp, 0), nil
+}
+
+// check if the deleted dataset still has data kubernetes depends on.
+// returns the reason it is in use, or the empty string if it can be destroyed.
+func deletedDatasetInUse(client *ZfsClient, dataset string) (string, error) {
+	snapshots, err := client.ListSnapshots([]string{dataset}, []string{ZFS_PROPERTY_SNAPSHOT, ZFS_PROPERTY_RELEASED, ZFS_PROPERTY_CLONES})
+	if err != nil {
+		return "", err
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.properties[ZFS_PROPERTY_SNAPSHOT] != "-" && snapshot.properties[ZFS_PROPERTY_RELEASED] != ZFS_PROPERTY_RELEASED_TRUE {
+			return fmt.Sprintf("volume snapshot %s still exists", snapshot.properties[ZFS_PROPERTY_SNAPSHOT]), nil
+		}
+		if hasClones(&snapshot) {
+			return fmt.Sprintf("snapshot %s has clones %s", snapshot.name, snapshot.properties[ZFS_PROPERTY_CLONES]), nil
+		}
+	}
+	return "", nil
+}
+
+func formatRetention(retention *time.Duration) string {
+	if retention == nil {
+		return RETENTION_FOREVER
+	}
+	return retention.String()
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeletedDatasetExpired(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	week := 7 * 24 * time.Hour
+	day := 24 * time.Hour
+
+	cases := []struct {
+		dataset  map[string]string
+		expected bool
+	}{
+		// deleted 8 days ago, default retention of a week
+		{map[string]string{ZFS_PROPERTY_NAME: "tank/csi/default-data-1", ZFS_PROPERTY_DELETED_AT: "1699308800", ZFS_PROPERTY_DELETED_RETENTION: "-"}, true},
+		// deleted 2 days ago
+		{map[string]string{ZFS_PROPERTY_NAME: "tank/csi/default-data-1", ZFS_PROPERTY_DELETED_AT: "1699827200", ZFS_PROPERTY_DELETED_RETENTION: "-"}, false},
+		// the storage class overrides the retention
+		{map[string]string{ZFS_PROPERTY_NAME: "tank/csi/default-data-1", ZFS_PROPERTY_DELETED_AT: "1699827200", ZFS_PROPERTY_DELETED_RETENTION: "1d"}, true},
+		{map[string]string{ZFS_PROPERTY_NAME: "tank/csi/default-data-1", ZFS_PROPERTY_DELETED_AT: "1699308800", ZFS_PROPERTY_DELETED_RETENTION: "forever"}, false},
+		// deleted before deleted-at existed, the timestamp is in the name
+		{map[string]string{ZFS_PROPERTY_NAME: "tank/csi/default-data-1699308800", ZFS_PROPERTY_DELETED_AT: "-", ZFS_PROPERTY_DELETED_RETENTION: "-"}, true},
+	}
+	for _, c := range cases {
+		expired, err := deletedDatasetExpired(c.dataset, &week, now)
+		if err != nil || expired != c.expected {
+			t.Errorf("expected %v for %v, got %v %v", c.expected, c.dataset, expired, err)
+		}
+	}
+
+	expired, err := deletedDatasetExpired(map[string]string{ZFS_PROPERTY_NAME: "tank/csi/default-data-1", ZFS_PROPERTY_DELETED_AT: "1", ZFS_PROPERTY_DELETED_RETENTION: "-"}, nil, now)
+	if err != nil || expired {
+		t.Errorf("expected datasets to be kept forever without a retention, got %v %v", expired, err)
+	}
+
+	if _, err := deletedDatasetExpired(map[string]string{ZFS_PROPERTY_NAME: "tank/csi/default-data", ZFS_PROPERTY_DELETED_AT: "-", ZFS_PROPERTY_DELETED_RETENTION: "-"}, &day, now); err == nil {
+		t.Errorf("expected an error when the deletion time is unknown")
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// name of the storage host to create the volume on, defaults to the first configured host
+const PARAMETER_STORAGE_HOST = "storageHost"
+
+// separates the storage host name from the rest of a volume or snapshot id
+const STORAGE_HOST_ID_SEPARATOR = "/"
+
+// a zfs host volumes can be created on
+type StorageHost struct {
+	// used in volume and snapshot ids and in the storageHost parameter
+	Name string
+	// the node name of the storage host, also used to connect to it over ssh and nfs
+	Hostname      string
+	ParentDataset string
+	// volumes with delete policy snapshot are copied here when deleted, empty if not configured
+	ArchiveDataset string
+	// zone of the storage host, used as the topology of volumes with placement zone
+	Zone string
+	// bytes of the parent dataset's available space that are never reported as capacity
+	CapacityReserve uint64
+	Client          *ZfsClient
+}
+
+// an entry of STORAGE_HOSTS, empty fields fall back to the single host environment variables
+type StorageHostConfig struct {
+	Name            string `json:"name"`
+	Hostname        string `json:"hostname"`
+	SshPort         string `json:"sshPort"`
+	SshUser         string `json:"sshUser"`
+	SshKey          string `json:"sshKey"`
+	Sudo            *bool  `json:"sudo"`
+	Dataset         string `json:"dataset"`
+	ArchiveDataset  string `json:"archiveDataset"`
+	Zone            string `json:"zone"`
+	CapacityReserve string `json:"capacityReserve"`
+}
+
+// the configured storage hosts, the first one is the default
+type StorageHosts []*StorageHost
+
+// load the storage hosts from STORAGE_HOSTS.
+// if it is not set a single host is configured from the STORAGE_* environment variables.
+func loadStorageHostConfigs() ([]StorageHostConfig, error) {
+	configs := []StorageHostConfig{}
+	value := os.Getenv(ENV_STORAGE_HOSTS)
+	if value == "" {
+		configs = append(configs, StorageHostConfig{})
+	} else if err := json.Unmarshal([]byte(value), &configs); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", ENV_STORAGE_HOSTS, err)
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("%s must contain at least one host", ENV_STORAGE_HOSTS)
+	}
+
+	names := map[string]bool{}
+	for i := range configs {
+		config := &configs[i]
+		if config.Hostname == "" {
+			config.Hostname = os.Getenv(ENV_STORAGE_HOST)
+		}
+		if config.Name == "" {
+			config.Name = config.Hostname
+		}
+		if config.SshPort == "" {
+			config.SshPort = getEnvOrDefault(ENV_STORAGE_SSH_PORT, "22")
+		}
+		if config.SshUser == "" {
+			config.SshUser = os.Getenv(ENV_STORAGE_SSH_USER)
+		}
+		if config.SshKey == "" {
+			config.SshKey = os.Getenv(ENV_STORAGE_SSH_KEY)
+		}
+		if config.Sudo == nil {
+			sudo := os.Getenv(ENV_STORAGE_ZFS_SUDO) == "true"
+			config.Sudo = &sudo
+		}
+		if config.Dataset == "" {
+			config.Dataset = os.Getenv(ENV_STORAGE_ZFS_DATASET)
+		}
+		if config.ArchiveDataset == "" {
+			config.ArchiveDataset = os.Getenv(ENV_STORAGE_ZFS_ARCHIVE_DATASET)
+		}
+		if config.Zone == "" {
+			config.Zone = os.Getenv(ENV_STORAGE_ZONE)
+		}
+		if config.CapacityReserve == "" {
+			config.CapacityReserve = os.Getenv(ENV_STORAGE_CAPACITY_RESERVE)
+		}
+
+		if config.Hostname == "" || config.SshUser == "" || config.SshKey == "" || config.Dataset == "" {
+			return nil, fmt.Errorf("storage host %d is missing one of hostname, sshUser, sshKey or dataset", i)
+		}
+		if strings.Contains(config.Name, STORAGE_HOST_ID_SEPARATOR) {
+			return nil, fmt.Errorf("storage host name cannot contain '%s': %s", STORAGE_HOST_ID_SEPARATOR, config.Name)
+		}
+		if names[config.Name] {
+			return nil, fmt.Errorf("duplicate storage host name: %s", config.Name)
+		}
+		names[config.Name] = true
+	}
+	return configs, nil
+}
+
+func createStorageHosts() (StorageHosts, error) {
+	configs, err := loadStorageHostConfigs()
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := StorageHosts{}
+	for _, config := range configs {
+		reserve := uint64(0)
+		if config.CapacityReserve != "" {
+			size, err := parseQuota(config.CapacityReserve)
+			if err != nil {
+				return nil, fmt.Errorf("invalid capacity reserve of storage host %s: %v", config.Name, err)
+			}
+			if size != nil {
+				reserve = *size
+			}
+		}
+
+		client, err := createZfsClient(config)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to storage host %s: %v", config.Name, err)
+		}
+
+		hosts = append(hosts, &StorageHost{
+			Name:            config.Name,
+			Hostname:        config.Hostname,
+			ParentDataset:   config.Dataset,
+			ArchiveDataset:  config.ArchiveDataset,
+			Zone:            config.Zone,
+			CapacityReserve: reserve,
+			Client:          client,
+		})
+	}
+	return hosts, nil
+}
+
+func createSshClient(config StorageHostConfig) (*ssh.Client, error) {
+	signer, err := ssh.ParsePrivateKey([]byte(config.SshKey))
+	if err != nil {
+		log.Printf("Error parsing key: %v", err)
+		return nil, err
+	}
+	host := fmt.Sprintf("%s:%s", config.Hostname, config.SshPort)
+	log.Printf("ssh dialing: %s@%s", config.SshUser, host)
+	return ssh.Dial("tcp", host, &ssh.ClientConfig{
+		User: config.SshUser,
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(signer),
+		},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         SSH_DIAL_TIMEOUT,
+	})
+}
+
+func createZfsClient(config StorageHostConfig) (*ZfsClient, error) {
+	executor, err := newSshExecutor(func() (*ssh.Client, error) {
+		return createSshClient(config)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ZfsClient{
+		executor: executor,
+		sudo:     *config.Sudo,
+	}, nil
+}
+
+func (h StorageHosts) Default() *StorageHost {
+	return h[0]
+}
+
+// get the host with the given name, returns a NotFound error if there is none.
+func (h StorageHosts) Get(name string) (*StorageHost, error) {
+	for _, host := range h {
+		if host.Name == name {
+			return host, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "unknown storage host: %s", name)
+}
+
+// get the host selected by the storageHost parameter.
+func (h StorageHosts) FromParameters(parameters map[string]string) (*StorageHost, error) {
+	name, ok := parameters[PARAMETER_STORAGE_HOST]
+	if !ok {
+		return h.Default(), nil
+	}
+	host, err := h.Get(name)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid value for parameter %s: %v", PARAMETER_STORAGE_HOST, err)
+	}
+	return host, nil
+}
+
+// get the host a volume or snapshot id belongs to.
+// ids created before multiple hosts were supported have no host and belong to the default host.
+func (h StorageHosts) FromId(id string) (*StorageHost, error) {
+	name, _, ok := strings.Cut(id, STORAGE_HOST_ID_SEPARATOR)
+	if !ok {
+		return h.Default(), nil
+	}
+	return h.Get(name)
+}
+
+// the parent datasets of the host that can contain volumes.
+// besides the configured one, every parent dataset a volume was created in through PARAMETER_PARENT_DATASETS.
+// a parent can be nested in another, only the direct children of every parent are volumes so both are kept, see withoutNestedDatasets.
+func (h *StorageHost) ParentDatasets() ([]string, error) {
+	parents, err := h.Client.ListPropertyValues(ZFS_PROPERTY_PARENT_DATASET)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(parents, h.ParentDataset) {
+		parents = append([]string{h.ParentDataset}, parents...)
+	}
+	return parents, nil
+}
+
+// the id of a volume or snapshot created on the host.
+// the zfs properties store the full id so lookups by id don't depend on the host it encodes.
+func (h *StorageHost) Id(name string) string {
+	return h.Name + STORAGE_HOST_ID_SEPARATOR + name
+}
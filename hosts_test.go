@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestStorageHostsFromId(t *testing.T) {
+	hosts := StorageHosts{
+		{Name: "citadel"},
+		{Name: "xen"},
+	}
+
+	host, err := hosts.FromId("pvc-1234")
+	if err != nil || host.Name != "citadel" {
+		t.Errorf("expected ids without a host to belong to the default host, got %v %v", host, err)
+	}
+
+	host, err = hosts.FromId(hosts[1].Id("pvc-1234"))
+	if err != nil || host.Name != "xen" {
+		t.Errorf("expected the host encoded in the id, got %v %v", host, err)
+	}
+
+	if _, err := hosts.FromId("blackmesa/pvc-1234"); err == nil {
+		t.Errorf("expected an error for an unknown host")
+	}
+
+	host, err = hosts.FromParameters(map[string]string{PARAMETER_STORAGE_HOST: "xen"})
+	if err != nil || host.Name != "xen" {
+		t.Errorf("expected the host from the parameters, got %v %v", host, err)
+	}
+
+	if _, err := hosts.FromParameters(map[string]string{PARAMETER_STORAGE_HOST: "blackmesa"}); err == nil {
+		t.Errorf("expected an error for an unknown host parameter")
+	}
+}
+
+func TestLoadStorageHostConfigs(t *testing.T) {
+	t.Setenv(ENV_STORAGE_HOST, "citadel")
+	t.Setenv(ENV_STORAGE_SSH_USER, "core")
+	t.Setenv(ENV_STORAGE_SSH_KEY, "key")
+	t.Setenv(ENV_STORAGE_ZFS_SUDO, "true")
+	t.Setenv(ENV_STORAGE_ZFS_DATASET, "blackmesa/csi")
+
+	configs, err := loadStorageHostConfigs()
+	if err != nil || len(configs) != 1 {
+		t.Fatalf("expected a single host from the legacy variables, got %v %v", configs, err)
+	}
+	if configs[0].Name != "citadel" || configs[0].SshPort != "22" || !*configs[0].Sudo || configs[0].Dataset != "blackmesa/csi" {
+		t.Errorf("unexpected legacy host config: %+v", configs[0])
+	}
+
+	t.Setenv(ENV_STORAGE_HOSTS, `[{"hostname": "citadel"}, {"name": "xen", "hostname": "xen.lan", "sudo": false, "dataset": "tank/csi"}]`)
+	configs, err = loadStorageHostConfigs()
+	if err != nil || len(configs) != 2 {
+		t.Fatalf("expected two hosts, got %v %v", configs, err)
+	}
+	if configs[1].Name != "xen" || configs[1].SshUser != "core" || *configs[1].Sudo || configs[1].Dataset != "tank/csi" {
+		t.Errorf("unexpected host config: %+v", configs[1])
+	}
+
+	t.Setenv(ENV_STORAGE_HOSTS, `[{"name": "citadel"}, {"name": "citadel"}]`)
+	if _, err := loadStorageHostConfigs(); err == nil {
+		t.Errorf("expected an error for duplicate host names")
+	}
+
+	t.Setenv(ENV_STORAGE_HOSTS, `[{"name": "a/b"}]`)
+	if _, err := loadStorageHostConfigs(); err == nil {
+		t.Errorf("expected an error for a host name containing the id separator")
+	}
+}
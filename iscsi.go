@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	// naming authority of the iqns of the targets and initiators created by the driver
+	ISCSI_IQN_PREFIX = "iqn.2024-01.sh.d464.infra"
+	ISCSI_PORT       = "3260"
+	// iscsiadm interface the node logs in with, it carries the initiator name derived from the node id
+	// so the node's own /etc/iscsi/initiatorname.iscsi is never used
+	ISCSI_IFACE = "storage-csi"
+
+	// publish context of volumes exported over iscsi, the iqn of the target the node logs in to
+	PUBLISH_CONTEXT_ISCSI_TARGET = "iscsiTarget"
+
+	// iscsiadm exit codes
+	ISCSI_ERR_SESS_EXISTS   = 15
+	ISCSI_ERR_NO_OBJS_FOUND = 21
+)
+
+var exportNameRegex = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// make the string usable in an iqn or nqn and as the name of a lio backstore.
+func exportName(name string) string {
+	return exportNameRegex.ReplaceAllString(strings.ToLower(name), "-")
+}
+
+// the iqn of the target that exports the volume, both the controller and the node derive it from the volume id.
+func iscsiTargetIqn(volumeId string) string {
+	return fmt.Sprintf("%s:volume.%s", ISCSI_IQN_PREFIX, exportName(volumeId))
+}
+
+// the iqn the node logs in with, the target's acl only allows the nodes the volume is published to.
+func iscsiInitiatorIqn(nodeId string) string {
+	return fmt.Sprintf("%s:node.%s", ISCSI_IQN_PREFIX, exportName(nodeId))
+}
+
+// list the children of a targetcli path, ex: the targets in /iscsi.
+func (z *ZfsClient) targetcliList(path string) ([]string, error) {
+	output, err := z.runArgs([]string{"targetcli", path, "ls", "depth=1"})
+	if err != nil {
+		return nil, err
+	}
+	children := []string{}
+	// the first line is the path itself, every other line is a child: `  o- <name> ... [<details>]`
+	for _, line := range strings.Split(output, "\n")[1:] {
+		_, entry, ok := strings.Cut(line, "o- ")
+		if !ok {
+			continue
+		}
+		children = append(children, strings.Fields(entry)[0])
+	}
+	return children, nil
+}
+
+// export the zvol device as lun 0 of the target, nothing is changed if it already is.
+func (z *ZfsClient) CreateIscsiTarget(target, backstore, device string) error {
+	backstores, err := z.targetcliList("/backstores/block")
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(backstores, backstore) {
+		if _, err := z.runArgs([]string{"targetcli", "/backstores/block", "create", "name=" + backstore, "dev=" + device}); err != nil {
+			return err
+		}
+	}
+
+	targets, err := z.ListIscsiTargets()
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(targets, target) {
+		if _, err := z.runArgs([]string{"targetcli", "/iscsi", "create", target}); err != nil {
+			return err
+		}
+		// only the initiators in the acls can log in
+		if _, err := z.runArgs([]string{"targetcli", "/iscsi/" + target + "/tpg1", "set", "attribute", "authentication=0", "generate_node_acls=0"}); err != nil {
+			return err
+		}
+	}
+
+	luns, err := z.targetcliList("/iscsi/" + target + "/tpg1/luns")
+	if err != nil {
+		return err
+	}
+	if len(luns) == 0 {
+		if _, err := z.runArgs([]string{"targetcli", "/iscsi/" + target + "/tpg1/luns", "create", "/backstores/block/" + backstore}); err != nil {
+			return err
+		}
+	}
+	log.Printf("Exported %s over iscsi as %s", device, target)
+	return z.saveTargetConfig()
+}
+
+// remove the target and its backstore, nothing is changed if they don't exist.
+func (z *ZfsClient) DeleteIscsiTarget(target, backstore string) error {
+	targets, err := z.ListIscsiTargets()
+	if err != nil {
+		return err
+	}
+	if slices.Contains(targets, target) {
+		if _, err := z.runArgs([]string{"targetcli", "/iscsi", "delete", target}); err != nil {
+			return err
+		}
+	}
+
+	backstores, err := z.targetcliList("/backstores/block")
+	if err != nil {
+		return err
+	}
+	if slices.Contains(backstores, backstore) {
+		if _, err := z.runArgs([]string{"targetcli", "/backstores/block", "delete", backstore}); err != nil {
+			return err
+		}
+	}
+	log.Printf("Deleted iscsi target %s", target)
+	return z.saveTargetConfig()
+}
+
+func (z *ZfsClient) ListIscsiTargets() ([]string, error) {
+	return z.targetcliList("/iscsi")
+}
+
+// list the initiators allowed to log in to the target.
+func (z *ZfsClient) ListIscsiInitiators(target string) ([]string, error) {
+	return z.targetcliList("/iscsi/" + target + "/tpg1/acls")
+}
+
+func (z *ZfsClient) AddIscsiInitiator(target, initiator string) error {
+	initiators, err := z.ListIscsiInitiators(target)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(initiators, initiator) {
+		return nil
+	}
+	// the lun of the target is mapped to new acls automatically
+	if _, err := z.runArgs([]string{"targetcli", "/iscsi/" + target + "/tpg1/acls", "create", initiator}); err != nil {
+		return err
+	}
+	return z.saveTargetConfig()
+}
+
+func (z *ZfsClient) RemoveIscsiInitiator(target, initiator string) error {
+	initiators, err := z.ListIscsiInitiators(target)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(initiators, initiator) {
+		return nil
+	}
+	if _, err := z.runArgs([]string{"targetcli", "/iscsi/" + target + "/tpg1/acls", "delete", initiator}); err != nil {
+		return err
+	}
+	return z.saveTargetConfig()
+}
+
+// persist the lio configuration so exports survive a reboot of the storage host.
+func (z *ZfsClient) saveTargetConfig() error {
+	_, err := z.runArgs([]string{"targetcli", "saveconfig"})
+	return err
+}
+
+// log in to the target with the node's initiator name and wait for the device of its lun.
+// logging in to a target the node is already logged in to only returns the device.
+func iscsiLogin(ctx context.Context, target, storageHostname, initiator string) (string, error) {
+	ips, err := net.LookupHost(storageHostname)
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("no IPs found for hostname %s", storageHostname)
+	}
+	// the device links in /dev/disk/by-path contain the address, not the hostname
+	portal := net.JoinHostPort(ips[0], ISCSI_PORT)
+
+	if _, err := runNodeCommand(ctx, "iscsiadm", "-m", "iface", "-I", ISCSI_IFACE, "-o", "show"); err != nil {
+		if _, err := runNodeCommand(ctx, "iscsiadm", "-m", "iface", "-I", ISCSI_IFACE, "-o", "new"); err != nil {
+			return "", err
+		}
+	}
+	if _, err := runNodeCommand(ctx, "iscsiadm", "-m", "iface", "-I", ISCSI_IFACE, "-o", "update", "-n", "iface.initiatorname", "-v", initiator); err != nil {
+		return "", err
+	}
+	if _, err := runNodeCommand(ctx, "iscsiadm", "-m", "node", "-T", target, "-p", portal, "-I", ISCSI_IFACE, "-o", "new"); err != nil {
+		return "", err
+	}
+	if _, err := runNodeCommand(ctx, "iscsiadm", "-m", "node", "-T", target, "-p", portal, "-I", ISCSI_IFACE, "--login"); err != nil && commandExitCode(err) != ISCSI_ERR_SESS_EXISTS {
+		return "", err
+	}
+
+	device := fmt.Sprintf("/dev/disk/by-path/ip-%s-iscsi-%s-lun-0", portal, target)
+	if err := waitForDevice(ctx, device, DEVICE_TIMEOUT); err != nil {
+		return "", err
+	}
+	return device, nil
+}
+
+// log out of every session to the target and forget it, nothing happens if the node is not logged in.
+// sessions are looked up in sysfs so nodes that never used iscsi don't need iscsiadm.
+func iscsiLogout(ctx context.Context, target string) error {
+	loggedIn, err := iscsiSessionExists(target)
+	if err != nil {
+		return err
+	}
+	if !loggedIn {
+		return nil
+	}
+	if _, err := runNodeCommand(ctx, "iscsiadm", "-m", "node", "-T", target, "--logout"); err != nil && commandExitCode(err) != ISCSI_ERR_NO_OBJS_FOUND {
+		return err
+	}
+	if _, err := runNodeCommand(ctx, "iscsiadm", "-m", "node", "-T", target, "-o", "delete"); err != nil && commandExitCode(err) != ISCSI_ERR_NO_OBJS_FOUND {
+		return err
+	}
+	return nil
+}
+
+// check if the node has a session to the target.
+func iscsiSessionExists(target string) (bool, error) {
+	paths, err := filepath.Glob("/sys/class/iscsi_session/session*/targetname")
+	if err != nil {
+		return false, err
+	}
+	for _, path := range paths {
+		name, err := os.ReadFile(path)
+		if err != nil {
+			return false, err
+		}
+		if strings.TrimSpace(string(name)) == target {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// make the node pick up the new size of the target's lun after the zvol was expanded.
+func iscsiRescan(ctx context.Context, target string) error {
+	loggedIn, err := iscsiSessionExists(target)
+	if err != nil || !loggedIn {
+		return err
+	}
+	_, err = runNodeCommand(ctx, "iscsiadm", "-m", "node", "-T", target, "-R")
+	return err
+}
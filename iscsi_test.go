@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestIscsiIqn(t *testing.T) {
+	if iqn := iscsiTargetIqn("citadel/pvc-1234"); iqn != "iqn.2024-01.sh.d464.infra:volume.citadel-pvc-1234" {
+		t.Errorf("unexpected target iqn %s", iqn)
+	}
+	if iqn := iscsiTargetIqn("pvc-1234"); iqn != "iqn.2024-01.sh.d464.infra:volume.pvc-1234" {
+		t.Errorf("unexpected target iqn for a volume without host %s", iqn)
+	}
+	if iqn := iscsiInitiatorIqn("Worker_1.lan"); iqn != "iqn.2024-01.sh.d464.infra:node.worker-1.lan" {
+		t.Errorf("unexpected initiator iqn %s", iqn)
+	}
+}
+
+func TestIscsiCommands(t *testing.T) {
+	target := "iqn.2024-01.sh.d464.infra:volume.citadel-pvc-1"
+	initiator := "iqn.2024-01.sh.d464.infra:node.worker1"
+	runCommandTests(t, []commandTest{
+		{
+			name: "CreateIscsiTarget",
+			outputs: map[string]string{
+				"targetcli /backstores/block ls depth=1":               "o- block ........ [Storage Objects: 0]",
+				"targetcli /iscsi ls depth=1":                          "o- iscsi ........ [Targets: 0]",
+				"targetcli /iscsi/" + target + "/tpg1/luns ls depth=1": "o- luns ........ [LUNs: 0]",
+			},
+			run: func(z *ZfsClient) error {
+				return z.CreateIscsiTarget(target, "citadel-pvc-1", "/dev/zvol/pool/csi/pvc-1")
+			},
+			commands: []string{
+				"targetcli /backstores/block ls depth=1",
+				"targetcli /backstores/block create name=citadel-pvc-1 dev=/dev/zvol/pool/csi/pvc-1",
+				"targetcli /iscsi ls depth=1",
+				"targetcli /iscsi create " + target,
+				"targetcli /iscsi/" + target + "/tpg1 set attribute authentication=0 generate_node_acls=0",
+				"targetcli /iscsi/" + target + "/tpg1/luns ls depth=1",
+				"targetcli /iscsi/" + target + "/tpg1/luns create /backstores/block/citadel-pvc-1",
+				"targetcli saveconfig",
+			},
+		},
+		{
+			name: "DeleteIscsiTarget",
+			outputs: map[string]string{
+				"targetcli /iscsi ls depth=1":            "o- iscsi ........ [Targets: 1]\n  o- " + target + " ........ [TPGs: 1]",
+				"targetcli /backstores/block ls depth=1": "o- block ........ [Storage Objects: 1]\n  o- citadel-pvc-1 ........ [/dev/zvol/pool/csi/pvc-1 (1.0GiB) write-thru activated]",
+			},
+			run: func(z *ZfsClient) error { return z.DeleteIscsiTarget(target, "citadel-pvc-1") },
+			commands: []string{
+				"targetcli /iscsi ls depth=1",
+				"targetcli /iscsi delete " + target,
+				"targetcli /backstores/block ls depth=1",
+				"targetcli /backstores/block delete citadel-pvc-1",
+				"targetcli saveconfig",
+			},
+		},
+		{
+			name: "ListIscsiTargets",
+			run: func(z *ZfsClient) error {
+				_, err := z.ListIscsiTargets()
+				return err
+			},
+			commands: []string{"targetcli /iscsi ls depth=1"},
+		},
+		{
+			name: "ListIscsiInitiators",
+			run: func(z *ZfsClient) error {
+				_, err := z.ListIscsiInitiators(target)
+				return err
+			},
+			commands: []string{"targetcli /iscsi/" + target + "/tpg1/acls ls depth=1"},
+		},
+		{
+			name:    "AddIscsiInitiator",
+			outputs: map[string]string{"targetcli /iscsi/" + target + "/tpg1/acls ls depth=1": "o- acls ........ [ACLs: 0]"},
+			run:     func(z *ZfsClient) error { return z.AddIscsiInitiator(target, initiator) },
+			commands: []string{
+				"targetcli /iscsi/" + target + "/tpg1/acls ls depth=1",
+				"targetcli /iscsi/" + target + "/tpg1/acls create " + initiator,
+				"targetcli saveconfig",
+			},
+		},
+		{
+			name:    "RemoveIscsiInitiator",
+			outputs: map[string]string{"targetcli /iscsi/" + target + "/tpg1/acls ls depth=1": "o- acls ........ [ACLs: 1]\n  o- " + initiator + " ........ [Mapped LUNs: 1]"},
+			run:     func(z *ZfsClient) error { return z.RemoveIscsiInitiator(target, initiator) },
+			commands: []string{
+				"targetcli /iscsi/" + target + "/tpg1/acls ls depth=1",
+				"targetcli /iscsi/" + target + "/tpg1/acls delete " + initiator,
+				"targetcli saveconfig",
+			},
+		},
+	})
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// what happened to the key of a volume when rotating keys
+const (
+	KEY_ROTATION_ROTATED    = "rotated"
+	KEY_ROTATION_UP_TO_DATE = "up to date"
+	// the volume is encrypted with a key that is neither the new nor the previous key, ex: the key of another storage class
+	KEY_ROTATION_SKIPPED = "skipped"
+	KEY_ROTATION_FAILED  = "failed"
+)
+
+// changes the keys of the encrypted volumes from the previous key to the new key of a secret
+type KeyRotation struct {
+	// the secret of the storage class, with SECRET_ENCRYPTION_KEY, SECRET_ENCRYPTION_KEY_VERSION and SECRET_PREVIOUS_ENCRYPTION_KEY
+	secrets map[string]string
+	version string
+}
+
+// run the rotate-keys subcommand with the secret mounted in the directory, exits with an error if the key of any volume could not be rotated.
+func rotateKeys(secretDirectory string) {
+	secrets, err := readSecretDirectory(secretDirectory)
+	if err != nil {
+		log.Fatalf("Error reading secret directory %s: %v", secretDirectory, err)
+	}
+	rotation, err := keyRotationFromSecrets(secrets)
+	if err != nil {
+		log.Fatalf("Invalid secret in directory %s: %v", secretDirectory, err)
+	}
+	hosts, err := createStorageHosts()
+	if err != nil {
+		log.Fatalf("Error creating storage hosts: %v", err)
+	}
+
+	results := map[string]int{}
+	for _, host := range hosts {
+		if err := rotation.rotateHost(host, results); err != nil {
+			results[KEY_ROTATION_FAILED]++
+			log.Printf("Error rotating keys on host %s: %v", host.Name, err)
+		}
+	}
+	log.Printf("Rotated keys to version %s: %d rotated, %d up to date, %d skipped, %d failed",
+		rotation.version, results[KEY_ROTATION_ROTATED], results[KEY_ROTATION_UP_TO_DATE], results[KEY_ROTATION_SKIPPED], results[KEY_ROTATION_FAILED])
+	if results[KEY_ROTATION_FAILED] > 0 {
+		os.Exit(1)
+	}
+}
+
+// read a secret mounted as a volume, every file is a key of the secret.
+func readSecretDirectory(dir string) (map[string]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	secrets := map[string]string{}
+	for _, entry := range entries {
+		// kubernetes keeps the files of the current version of the secret in ..data
+		if strings.HasPrefix(entry.Name(), ".") || entry.IsDir() {
+			continue
+		}
+		value, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		secrets[entry.Name()] = string(value)
+	}
+	return secrets, nil
+}
+
+// the new key and its version are required, the previous key is only needed for volumes that still use it.
+func keyRotationFromSecrets(secrets map[string]string) (*KeyRotation, error) {
+	if key, ok := secrets[SECRET_ENCRYPTION_KEY]; !ok || key == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "secret %s must contain the encryption key", SECRET_ENCRYPTION_KEY)
+	}
+	version, err := keyVersionFromSecrets(secrets)
+	if err != nil {
+		return nil, err
+	}
+	if version == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "secret %s must contain the version of the encryption key", SECRET_ENCRYPTION_KEY_VERSION)
+	}
+	return &KeyRotation{secrets: secrets, version: version}, nil
+}
+
+// rotate the keys of every encrypted volume of the host and count the results.
+func (r *KeyRotation) rotateHost(host *StorageHost, results map[string]int) error {
+	parents, err := host.ParentDatasets()
+	if err != nil {
+		return err
+	}
+	datasets, err := host.Client.ListChildDatasetProperties(parents, []string{
+		ZFS_PROPERTY_PV,
+		ZFS_PROPERTY_ENCRYPTION_ROOT,
+		ZFS_PROPERTY_KEYSTATUS,
+		ZFS_PROPERTY_KEYFORMAT,
+		ZFS_PROPERTY_KEY_VERSION,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, dataset := range datasets {
+		name := dataset[ZFS_PROPERTY_NAME]
+		// datasets that inherit their encryption change keys with their encryption root
+		if dataset[ZFS_PROPERTY_ENCRYPTION_ROOT] != name {
+			continue
+		}
+		result, err := r.rotateDataset(host.Client, dataset)
+		if err != nil {
+			result = KEY_ROTATION_FAILED
+			log.Printf("Error rotating key of dataset %s on host %s (pv %s): %v", name, host.Name, dataset[ZFS_PROPERTY_PV], err)
+		} else {
+			log.Printf("Key of dataset %s on host %s (pv %s): %s", name, host.Name, dataset[ZFS_PROPERTY_PV], result)
+		}
+		results[result]++
+	}
+	return nil
+}
+
+// change the key of the dataset to the new key if it is encrypted with the previous key and record the new version.
+// the dataset must have been listed with the keystatus, keyformat and key version properties.
+func (r *KeyRotation) rotateDataset(client *ZfsClient, dataset map[string]string) (string, error) {
+	name := dataset[ZFS_PROPERTY_NAME]
+	if dataset[ZFS_PROPERTY_KEY_VERSION] == r.version {
+		return KEY_ROTATION_UP_TO_DATE, nil
+	}
+
+	keyFormat := dataset[ZFS_PROPERTY_KEYFORMAT]
+	key, err := encryptionKeyFromSecrets(r.secrets, keyFormat)
+	if err != nil {
+		// a key that zfs doesn't accept in the dataset's format can't be its key
+		return KEY_ROTATION_SKIPPED, nil
+	}
+	current, err := client.CheckKey(name, key)
+	if err != nil {
+		return "", err
+	}
+
+	result := KEY_ROTATION_UP_TO_DATE
+	if !current {
+		previous, err := encryptionKeyFromSecrets(map[string]string{SECRET_ENCRYPTION_KEY: r.secrets[SECRET_PREVIOUS_ENCRYPTION_KEY]}, keyFormat)
+		if err != nil {
+			return KEY_ROTATION_SKIPPED, nil
+		}
+		matches, err := client.CheckKey(name, previous)
+		if err != nil {
+			return "", err
+		}
+		if !matches {
+			return KEY_ROTATION_SKIPPED, nil
+		}
+
+		// the key of volumes that are not in use is only loaded to change it
+		if dataset[ZFS_PROPERTY_KEYSTATUS] != ZFS_KEYSTATUS_AVAILABLE {
+			if err := client.LoadKey(name, previous); err != nil {
+				return "", err
+			}
+			defer func() {
+				if err := client.UnloadKey(name); err != nil {
+					log.Printf("Error unloading key of dataset %s: %v", name, err)
+				}
+			}()
+		}
+		if err := client.ChangeKey(name, key); err != nil {
+			return "", err
+		}
+		result = KEY_ROTATION_ROTATED
+	}
+
+	if err := client.UpdateProperty(name, ZFS_PROPERTY_KEY_VERSION, r.version); err != nil {
+		return "", fmt.Errorf("error recording key version: %v", err)
+	}
+	return result, nil
+}
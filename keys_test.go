@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadSecretDirectory(t *testing.T) {
+	dir := t.TempDir()
+	// the layout of a secret mounted as a volume
+	data := filepath.Join(dir, "..2026_10_17_00_00_00.000000000")
+	if err := os.Mkdir(data, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(data, SECRET_ENCRYPTION_KEY), []byte("correct horse battery staple"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Base(data), filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join("..data", SECRET_ENCRYPTION_KEY), filepath.Join(dir, SECRET_ENCRYPTION_KEY)); err != nil {
+		t.Fatal(err)
+	}
+
+	secrets, err := readSecretDirectory(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(secrets) != 1 || secrets[SECRET_ENCRYPTION_KEY] != "correct horse battery staple" {
+		t.Errorf("unexpected secrets: %v", secrets)
+	}
+}
+
+func TestKeyRotationFromSecrets(t *testing.T) {
+	rotation, err := keyRotationFromSecrets(map[string]string{
+		SECRET_ENCRYPTION_KEY:          "correct horse battery staple",
+		SECRET_ENCRYPTION_KEY_VERSION:  "2",
+		SECRET_PREVIOUS_ENCRYPTION_KEY: "hunter2hunter2",
+	})
+	if err != nil || rotation.version != "2" {
+		t.Errorf("expected version 2, got %v %v", rotation, err)
+	}
+
+	invalid := []map[string]string{
+		{SECRET_ENCRYPTION_KEY_VERSION: "2"},
+		{SECRET_ENCRYPTION_KEY: "correct horse battery staple"},
+		{SECRET_ENCRYPTION_KEY: "correct horse battery staple", SECRET_ENCRYPTION_KEY_VERSION: "two words"},
+	}
+	for _, secrets := range invalid {
+		if _, err := keyRotationFromSecrets(secrets); err == nil {
+			t.Errorf("expected an error for %v", secrets)
+		}
+	}
+}
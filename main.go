@@ -4,35 +4,122 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
-	"golang.org/x/crypto/ssh"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
+	// json list of storage hosts, see StorageHostConfig. replaces the single host variables below
+	ENV_STORAGE_HOSTS = "STORAGE_HOSTS"
+
 	ENV_STORAGE_HOST        = "STORAGE_HOST"
 	ENV_STORAGE_SSH_PORT    = "STORAGE_SSH_PORT"
 	ENV_STORAGE_SSH_USER    = "STORAGE_SSH_USER"
 	ENV_STORAGE_SSH_KEY     = "STORAGE_SSH_KEY"
 	ENV_STORAGE_ZFS_SUDO    = "STORAGE_SSH_SUDO"
 	ENV_STORAGE_ZFS_DATASET = "STORAGE_ZFS_DATASET"
+	// dataset the volumes with delete policy snapshot are archived to
+	ENV_STORAGE_ZFS_ARCHIVE_DATASET = "STORAGE_ZFS_ARCHIVE_DATASET"
+	// space of the parent dataset that is not reported as available capacity, ex: 100G
+	ENV_STORAGE_CAPACITY_RESERVE = "STORAGE_CAPACITY_RESERVE"
+	// zone of the storage host, required by volumes with placement zone
+	ENV_STORAGE_ZONE = "STORAGE_ZONE"
+	// zone of the node the node plugin runs in, reported as topology
+	ENV_NODE_ZONE = "NODE_ZONE"
+	// addresses of nodes whose id can't be resolved using dns, ex: node1=10.0.0.1,node2=10.0.0.2
+	ENV_STORAGE_NFS_NODE_ADDRESSES = "STORAGE_NFS_NODE_ADDRESSES"
+	// how long datasets of deleted volumes are kept before they are destroyed, ex: 7d. unset keeps them forever
+	ENV_STORAGE_GC_RETENTION = "STORAGE_GC_RETENTION"
+	// how often the garbage collector looks for expired datasets, defaults to 1h
+	ENV_STORAGE_GC_INTERVAL = "STORAGE_GC_INTERVAL"
+	// when true the garbage collector only logs the datasets it would destroy
+	ENV_STORAGE_GC_DRY_RUN = "STORAGE_GC_DRY_RUN"
+	// address to serve metrics on at /debug/vars, ex: :9090. unset disables the metrics server
+	ENV_METRICS_ADDRESS = "METRICS_ADDRESS"
 
 	ZFS_PROPERTY_SHARENFS      = "sharenfs"
-	ZFS_PROPERTY_SHARENFS_ON   = "on"
+	ZFS_PROPERTY_SHARENFS_OFF  = "off"
 	ZFS_PROPERTY_NAMESPACE     = "k8s:namespace"
 	ZFS_PROPERTY_PV            = "k8s:pv"
 	ZFS_PROPERTY_PVC           = "k8s:pvc"
 	ZFS_PROPERTY_DELETED       = "k8s:deleted"
 	ZFS_PROPERTY_DELETED_TRUE  = "true"
 	ZFS_PROPERTY_DELETED_FALSE = "false"
+	// what happens to the dataset when the volume is deleted, see PARAMETER_DELETE_POLICY
+	ZFS_PROPERTY_DELETE_POLICY = "k8s:delete-policy"
+	// unix timestamp of when the volume was archived, set on the copies in the archive dataset
+	ZFS_PROPERTY_ARCHIVED_AT = "k8s:archived-at"
+	// unix timestamp of when the volume was deleted
+	ZFS_PROPERTY_DELETED_AT = "k8s:deleted-at"
+	// how long the dataset is kept after the volume is deleted, see PARAMETER_DELETED_RETENTION
+	ZFS_PROPERTY_DELETED_RETENTION = "k8s:deleted-retention"
+
+	ZFS_PROPERTY_SNAPSHOT        = "k8s:snapshot"
+	ZFS_PROPERTY_SNAPSHOT_SOURCE = "k8s:snapshot-source"
+	// set on the temporary snapshots used to clone a volume, contains the id of the cloned volume
+	ZFS_PROPERTY_CLONE_TARGET = "k8s:clone-target"
+	// snapshots that are no longer referenced by kubernetes but could not be destroyed
+	// because they still have dependent clones.
+	ZFS_PROPERTY_RELEASED      = "k8s:released"
+	ZFS_PROPERTY_RELEASED_TRUE = "true"
+
+	// comma separated list of the node ids the volume is published to
+	ZFS_PROPERTY_PUBLISHED_NODES = "k8s:published-nodes"
+	// which zfs property limits the size of the volume, see PARAMETER_QUOTA_MODE
+	ZFS_PROPERTY_QUOTA_MODE = "k8s:quota-mode"
+	// the parent dataset the volume was created in, see PARAMETER_PARENT_DATASETS
+	ZFS_PROPERTY_PARENT_DATASET = "k8s:parent-dataset"
+	// how the zvol is exported to the nodes, see PARAMETER_BLOCK_PROTOCOL
+	ZFS_PROPERTY_BLOCK_PROTOCOL = "k8s:block-protocol"
+	// version of the key the volume is encrypted with, see SECRET_ENCRYPTION_KEY_VERSION
+	ZFS_PROPERTY_KEY_VERSION = "k8s:key-version"
+
+	ZFS_PROPERTY_NAME         = "name"
+	ZFS_PROPERTY_CLONES       = "clones"
+	ZFS_PROPERTY_QUOTA        = "quota"
+	ZFS_PROPERTY_REFQUOTA     = "refquota"
+	ZFS_PROPERTY_USED         = "used"
+	ZFS_PROPERTY_REFERENCED   = "referenced"
+	ZFS_PROPERTY_NONE         = "none"
+	ZFS_PROPERTY_READONLY     = "readonly"
+	ZFS_PROPERTY_ON           = "on"
+	ZFS_PROPERTY_TYPE         = "type"
+	ZFS_PROPERTY_VOLSIZE      = "volsize"
+	ZFS_PROPERTY_VOLBLOCKSIZE = "volblocksize"
+	ZFS_PROPERTY_ENCRYPTION   = "encryption"
+	ZFS_PROPERTY_KEYFORMAT    = "keyformat"
+	ZFS_PROPERTY_KEYLOCATION  = "keylocation"
+	ZFS_PROPERTY_KEYSTATUS    = "keystatus"
+	// the dataset whose key encrypts the dataset, itself unless the encryption is inherited
+	ZFS_PROPERTY_ENCRYPTION_ROOT = "encryptionroot"
+	ZFS_PROPERTY_MOUNTED         = "mounted"
+
+	ZFS_KEYLOCATION_PROMPT  = "prompt"
+	ZFS_KEYSTATUS_AVAILABLE = "available"
+
+	ZFS_TYPE_FILESYSTEM = "filesystem"
+	ZFS_TYPE_VOLUME     = "volume"
+
+	ZPOOL_HEALTH_ONLINE = "ONLINE"
 )
 
 func main() {
+	// admin command that exits once it is done instead of serving csi
+	if len(os.Args) == 3 && os.Args[1] == "rotate-keys" {
+		rotateKeys(os.Args[2])
+		return
+	}
 	if len(os.Args) != 2 {
-		log.Fatalf("Usage: %s <controller|node>", os.Args[0])
+		log.Fatalf("Usage: %s <controller|node> or %s rotate-keys <secret directory>", os.Args[0], os.Args[0])
 	}
 
 	listener, err := createListener()
@@ -43,29 +130,39 @@ func main() {
 	var opts []grpc.ServerOption
 	grpcServer := grpc.NewServer(opts...)
 
-	zfsClient, err := createZfsClient()
+	hosts, err := createStorageHosts()
 	if err != nil {
-		log.Fatalf("Error creating zfs client: %v", err)
+		log.Fatalf("Error creating storage hosts: %v", err)
 	}
 
 	mode := os.Args[1]
 	if mode == "controller" {
 		controller := &ControllerCsi{
 			config: &ControllerConfig{
-				ParentDataset: getEnvOrFail(ENV_STORAGE_ZFS_DATASET),
+				NfsNodeAddresses: getEnvMapOrDefault(ENV_STORAGE_NFS_NODE_ADDRESSES),
 			},
-			client: zfsClient,
+			hosts: hosts,
 		}
 		csi.RegisterIdentityServer(grpcServer, controller)
 		csi.RegisterControllerServer(grpcServer, controller)
+		go controller.RestoreNvmeofExports()
+
+		gc := &GarbageCollector{
+			config: &GarbageCollectorConfig{
+				Interval:  getEnvDurationOrDefault(ENV_STORAGE_GC_INTERVAL, time.Hour),
+				Retention: getEnvRetention(ENV_STORAGE_GC_RETENTION),
+				DryRun:    os.Getenv(ENV_STORAGE_GC_DRY_RUN) == "true",
+			},
+			hosts: hosts,
+		}
+		go gc.Run()
 	} else if mode == "node" {
 		node := &NodeCsi{
 			Config: &NodeConfig{
-				NodeHostname:    getEnvOrFail("NODE_ID"),
-				StorageHostname: getEnvOrFail(ENV_STORAGE_HOST),
-				ParentDataset:   getEnvOrFail(ENV_STORAGE_ZFS_DATASET),
+				NodeHostname: getEnvOrFail("NODE_ID"),
+				Zone:         os.Getenv(ENV_NODE_ZONE),
 			},
-			Client: zfsClient,
+			Hosts: hosts,
 		}
 		csi.RegisterIdentityServer(grpcServer, node)
 		csi.RegisterNodeServer(grpcServer, node)
@@ -73,6 +170,16 @@ func main() {
 		log.Fatalf("Invalid mode: %s", mode)
 	}
 
+	if address := os.Getenv(ENV_METRICS_ADDRESS); address != "" {
+		// expvar registers its handler at /debug/vars on the default mux
+		go func() {
+			log.Printf("Serving metrics on address: %s", address)
+			if err := http.ListenAndServe(address, nil); err != nil {
+				log.Printf("Error serving metrics: %v", err)
+			}
+		}()
+	}
+
 	log.Printf("Listening for connections on address: %#v", listener.Addr())
 	grpcServer.Serve(listener)
 }
@@ -120,38 +227,46 @@ func getEnvOrDefault(key, defaultValue string) string {
 	return value
 }
 
-func createSshClient() (*ssh.Client, error) {
-	key := getEnvOrFail(ENV_STORAGE_SSH_KEY)
-	signer, err := ssh.ParsePrivateKey([]byte(key))
-	if err != nil {
-		log.Printf("Error parsing key: %v", err)
-		return nil, err
+// parse a comma separated list of key=value pairs.
+func getEnvMapOrDefault(key string) map[string]string {
+	values := map[string]string{}
+	for _, pair := range strings.Split(os.Getenv(key), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || k == "" || v == "" {
+			log.Fatalf("Invalid key=value pair in environment variable %s: %s", key, pair)
+		}
+		values[k] = v
 	}
-	hostname := getEnvOrFail(ENV_STORAGE_HOST)
-	port := getEnvOrDefault(ENV_STORAGE_SSH_PORT, "22")
-	user := getEnvOrFail(ENV_STORAGE_SSH_USER)
-	host := fmt.Sprintf("%s:%s", hostname, port)
-	log.Printf("ssh dialing: %s@%s", user, host)
-	return ssh.Dial("tcp", host, &ssh.ClientConfig{
-		User: user,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-	})
+	return values
 }
 
-func createZfsClient() (*ZfsClient, error) {
-	sshClient, err := createSshClient()
-	if err != nil {
-		return nil, err
+func getEnvDurationOrDefault(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		log.Fatalf("Invalid duration in environment variable %s: %s", key, value)
 	}
-	sudo := getEnvOrFail(ENV_STORAGE_ZFS_SUDO) == "true"
+	return duration
+}
 
-	return &ZfsClient{
-		sshClient: sshClient,
-		sudo:      sudo,
-	}, nil
+// parse a retention period, an unset variable means forever.
+func getEnvRetention(key string) *time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return nil
+	}
+	retention, err := parseRetention(value)
+	if err != nil {
+		log.Fatalf("Invalid retention in environment variable %s: %v", key, err)
+	}
+	return retention
 }
 
 func createDatasetName(parentDataset, namespace, name string) string {
@@ -171,6 +286,12 @@ func createDatasetName(parentDataset, namespace, name string) string {
 	return parentDataset + "/" + volumeName
 }
 
+// check if the dataset is the parent dataset or one of its descendants.
+func isDatasetOrDescendant(dataset, parent string) bool {
+	return dataset == parent || strings.HasPrefix(dataset, parent+"/")
+}
+
+// find the dataset of a volume that is not deleted, returns NotFound if there is none.
 func findExistingDatasetByVolumeId(client *ZfsClient, volumeId string) (string, error) {
 	name, err := client.FindDatasetByProperties(map[string]string{
 		ZFS_PROPERTY_PV:      volumeId,
@@ -180,7 +301,276 @@ func findExistingDatasetByVolumeId(client *ZfsClient, volumeId string) (string,
 		return "", err
 	}
 	if name == "" {
-		return "", fmt.Errorf("dataset not found for volume id %s", volumeId)
+		return "", status.Errorf(codes.NotFound, "dataset not found for volume id %s", volumeId)
 	}
 	return name, nil
 }
+
+// find the dataset of a deleted volume, either by its volume id or by the namespace and name of its pvc.
+// if several match the most recently deleted one is returned, returns the empty string if none is found.
+func findDeletedDataset(host *StorageHost, volumeId, namespace, pvc string) (string, error) {
+	parents, err := host.ParentDatasets()
+	if err != nil {
+		return "", err
+	}
+	datasets, err := host.Client.ListChildDatasetProperties(parents, []string{
+		ZFS_PROPERTY_PV,
+		ZFS_PROPERTY_NAMESPACE,
+		ZFS_PROPERTY_PVC,
+		ZFS_PROPERTY_DELETED,
+		ZFS_PROPERTY_DELETED_AT,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	found, foundDeletedAt := "", time.Time{}
+	for _, dataset := range datasets {
+		if dataset[ZFS_PROPERTY_DELETED] != ZFS_PROPERTY_DELETED_TRUE {
+			continue
+		}
+		if volumeId != "" && dataset[ZFS_PROPERTY_PV] != volumeId {
+			continue
+		}
+		if volumeId == "" && (dataset[ZFS_PROPERTY_NAMESPACE] != namespace || dataset[ZFS_PROPERTY_PVC] != pvc) {
+			continue
+		}
+		// without a deletion time it can't be compared to the other candidates, so it is never restored
+		deletedAt, err := datasetDeletedAt(dataset)
+		if err != nil {
+			log.Printf("Skipping deleted dataset %s with an unknown deletion time: %v", dataset[ZFS_PROPERTY_NAME], err)
+			continue
+		}
+		if found == "" || deletedAt.After(foundDeletedAt) {
+			found, foundDeletedAt = dataset[ZFS_PROPERTY_NAME], deletedAt
+		}
+	}
+	return found, nil
+}
+
+// list all snapshots created through csi under the parent datasets of the host, sorted by snapshot id.
+func listCsiSnapshots(host *StorageHost) ([]ZfsSnapshotInfo, error) {
+	parents, err := host.ParentDatasets()
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := host.Client.ListSnapshots(parents, []string{ZFS_PROPERTY_SNAPSHOT, ZFS_PROPERTY_SNAPSHOT_SOURCE, ZFS_PROPERTY_RELEASED, ZFS_PROPERTY_CLONES})
+	if err != nil {
+		return nil, err
+	}
+
+	csiSnapshots := []ZfsSnapshotInfo{}
+	for _, snapshot := range snapshots {
+		// snapshots taken by hand have no id and are not managed by us
+		if snapshot.properties[ZFS_PROPERTY_SNAPSHOT] == "-" {
+			continue
+		}
+		// released snapshots have already been deleted as far as kubernetes is concerned
+		if snapshot.properties[ZFS_PROPERTY_RELEASED] == ZFS_PROPERTY_RELEASED_TRUE {
+			continue
+		}
+		csiSnapshots = append(csiSnapshots, snapshot)
+	}
+	sort.Slice(csiSnapshots, func(i, j int) bool {
+		return csiSnapshots[i].properties[ZFS_PROPERTY_SNAPSHOT] < csiSnapshots[j].properties[ZFS_PROPERTY_SNAPSHOT]
+	})
+	return csiSnapshots, nil
+}
+
+// find the snapshot with the given csi snapshot id.
+// returns nil if no snapshot is found.
+func findSnapshotById(host *StorageHost, snapshotId string) (*ZfsSnapshotInfo, error) {
+	snapshots, err := listCsiSnapshots(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.properties[ZFS_PROPERTY_SNAPSHOT] == snapshotId {
+			return &snapshot, nil
+		}
+	}
+	return nil, nil
+}
+
+// find the temporary snapshot used to clone the volume with the given id.
+// returns nil if no snapshot is found.
+func findCloneSnapshot(host *StorageHost, volumeId string) (*ZfsSnapshotInfo, error) {
+	parents, err := host.ParentDatasets()
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := host.Client.ListSnapshots(parents, []string{ZFS_PROPERTY_CLONE_TARGET})
+	if err != nil {
+		return nil, err
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.properties[ZFS_PROPERTY_CLONE_TARGET] == volumeId {
+			return &snapshot, nil
+		}
+	}
+	return nil, nil
+}
+
+// destroy all released snapshots that no longer have dependent clones.
+// snapshots that still have clones are kept until the clones are destroyed.
+func destroyReleasedSnapshots(host *StorageHost) error {
+	parents, err := host.ParentDatasets()
+	if err != nil {
+		return err
+	}
+	snapshots, err := host.Client.ListSnapshots(parents, []string{ZFS_PROPERTY_RELEASED, ZFS_PROPERTY_CLONES})
+	if err != nil {
+		return err
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.properties[ZFS_PROPERTY_RELEASED] != ZFS_PROPERTY_RELEASED_TRUE {
+			continue
+		}
+		if hasClones(&snapshot) {
+			log.Printf("Released snapshot still has clones, keeping it: %s", snapshot.name)
+			continue
+		}
+		if err := host.Client.DestroySnapshot(snapshot.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the snapshot must have been listed with the clones property.
+func hasClones(snapshot *ZfsSnapshotInfo) bool {
+	clones := snapshot.properties[ZFS_PROPERTY_CLONES]
+	return clones != "" && clones != "-"
+}
+
+// return a page of at most maxEntries items starting at the item whose id is startingToken.
+// the returned token is the id of the first item of the next page, or the empty string if there are no more items.
+// items must be sorted by id so the tokens stay valid when other items are added or removed.
+func paginate[T any](items []T, id func(T) string, maxEntries int32, startingToken string) ([]T, string, error) {
+	if maxEntries < 0 {
+		return nil, "", status.Error(codes.InvalidArgument, "max entries cannot be negative")
+	}
+
+	start := 0
+	if startingToken != "" {
+		start = -1
+		for i, item := range items {
+			if id(item) == startingToken {
+				start = i
+				break
+			}
+		}
+		if start == -1 {
+			return nil, "", status.Errorf(codes.Aborted, "invalid starting token: %s", startingToken)
+		}
+	}
+
+	end := len(items)
+	if maxEntries > 0 && start+int(maxEntries) < end {
+		end = start + int(maxEntries)
+	}
+
+	nextToken := ""
+	if end < len(items) {
+		nextToken = id(items[end])
+	}
+	return items[start:end], nextToken, nil
+}
+
+// get the quota mode of the dataset, datasets created before quota modes existed use QUOTA_MODE_QUOTA.
+func getVolumeQuotaMode(client *ZfsClient, dataset string) (string, error) {
+	mode, err := client.GetProperty(dataset, ZFS_PROPERTY_QUOTA_MODE)
+	if err != nil {
+		return "", err
+	}
+	if mode == "-" {
+		return QUOTA_MODE_QUOTA, nil
+	}
+	return mode, nil
+}
+
+// get the exact size the volume is limited to by whichever quota is set, the rounded size zfs list shows by default would change it.
+func getVolumeQuota(client *ZfsClient, dataset string) (int64, error) {
+	properties, err := client.GetProperties(dataset, []string{ZFS_PROPERTY_QUOTA, ZFS_PROPERTY_REFQUOTA})
+	if err != nil {
+		return 0, err
+	}
+	// with -p a quota that is not set is reported as 0
+	quota, err := strconv.ParseInt(properties[ZFS_PROPERTY_QUOTA], 10, 64)
+	if err == nil && quota == 0 {
+		quota, err = strconv.ParseInt(properties[ZFS_PROPERTY_REFQUOTA], 10, 64)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if quota == 0 {
+		return 0, status.Errorf(codes.Internal, "dataset %s has no quota", dataset)
+	}
+	return quota, nil
+}
+
+// limit the size of the volume using the property of the given quota mode.
+// the property of the other mode is cleared so switching modes doesn't leave a stale limit behind.
+func setVolumeQuota(client *ZfsClient, dataset, mode string, size int64) error {
+	properties := map[string]string{ZFS_PROPERTY_QUOTA_MODE: mode}
+	switch mode {
+	case QUOTA_MODE_QUOTA:
+		properties[ZFS_PROPERTY_QUOTA] = fmt.Sprintf("%d", size)
+		properties[ZFS_PROPERTY_REFQUOTA] = ZFS_PROPERTY_NONE
+	case QUOTA_MODE_REFQUOTA:
+		properties[ZFS_PROPERTY_QUOTA] = ZFS_PROPERTY_NONE
+		properties[ZFS_PROPERTY_REFQUOTA] = fmt.Sprintf("%d", size)
+	default:
+		return fmt.Errorf("invalid quota mode: %s", mode)
+	}
+	return client.UpdateProperties(dataset, properties)
+}
+
+// zvol sizes are rounded up to this when the volblocksize is not known, it is a multiple of every valid volblocksize
+const ZVOL_SIZE_ALIGNMENT = 128 * 1024
+
+// round the size up to a multiple of the block size, zfs rejects zvol sizes that are not.
+func roundVolumeSize(size, blocksize uint64) uint64 {
+	if blocksize == 0 {
+		blocksize = ZVOL_SIZE_ALIGNMENT
+	}
+	return (size + blocksize - 1) / blocksize * blocksize
+}
+
+func parsePublishedNodes(value string) []string {
+	nodes := []string{}
+	if value == "-" {
+		return nodes
+	}
+	for _, node := range strings.Split(value, ",") {
+		if node != "" {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+func formatPublishedNodes(nodes []string) string {
+	return strings.Join(nodes, ",")
+}
+
+// build the sharenfs value that exports the dataset read-write to the given addresses only.
+// without addresses the dataset is not shared at all.
+func sharenfsAccessList(addresses []string) string {
+	if len(addresses) == 0 {
+		return ZFS_PROPERTY_SHARENFS_OFF
+	}
+	hosts := []string{}
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		if ip != nil && ip.To4() != nil {
+			hosts = append(hosts, fmt.Sprintf("@%s/32", ip))
+		} else if ip != nil {
+			hosts = append(hosts, fmt.Sprintf("@[%s]/128", ip))
+		} else {
+			// not an ip, let the nfs server resolve it
+			hosts = append(hosts, address)
+		}
+	}
+	return "rw=" + strings.Join(hosts, ":")
+}
@@ -0,0 +1,104 @@
+package main
+
+import "testing"
+
+func TestPaginate(t *testing.T) {
+	items := []string{"a", "b", "c", "d", "e"}
+	id := func(s string) string { return s }
+
+	page, next, err := paginate(items, id, 0, "")
+	if err != nil || len(page) != 5 || next != "" {
+		t.Errorf("expected all items without a token, got %v %q %v", page, next, err)
+	}
+
+	page, next, err = paginate(items, id, 2, "")
+	if err != nil || len(page) != 2 || page[0] != "a" || next != "c" {
+		t.Errorf("expected first page, got %v %q %v", page, next, err)
+	}
+
+	page, next, err = paginate(items, id, 2, "c")
+	if err != nil || len(page) != 2 || page[0] != "c" || next != "e" {
+		t.Errorf("expected second page, got %v %q %v", page, next, err)
+	}
+
+	page, next, err = paginate(items, id, 2, "e")
+	if err != nil || len(page) != 1 || page[0] != "e" || next != "" {
+		t.Errorf("expected last page, got %v %q %v", page, next, err)
+	}
+
+	_, _, err = paginate(items, id, 2, "z")
+	if err == nil {
+		t.Errorf("expected an error for a stale token")
+	}
+
+	_, _, err = paginate(items, id, -1, "")
+	if err == nil {
+		t.Errorf("expected an error for negative max entries")
+	}
+}
+
+func TestSharenfsAccessList(t *testing.T) {
+	if v := sharenfsAccessList(nil); v != "off" {
+		t.Errorf("expected off without addresses, got %s", v)
+	}
+	if v := sharenfsAccessList([]string{"10.0.0.1", "10.0.0.2"}); v != "rw=@10.0.0.1/32:@10.0.0.2/32" {
+		t.Errorf("unexpected access list %s", v)
+	}
+	if v := sharenfsAccessList([]string{"fd00::1"}); v != "rw=@[fd00::1]/128" {
+		t.Errorf("unexpected access list %s", v)
+	}
+}
+
+func TestRoundVolumeSize(t *testing.T) {
+	if v := roundVolumeSize(1, 0); v != ZVOL_SIZE_ALIGNMENT {
+		t.Errorf("expected the default alignment, got %d", v)
+	}
+	if v := roundVolumeSize(16*1024, 8*1024); v != 16*1024 {
+		t.Errorf("expected aligned sizes to be kept, got %d", v)
+	}
+	if v := roundVolumeSize(16*1024+1, 8*1024); v != 24*1024 {
+		t.Errorf("expected the size rounded up to the block size, got %d", v)
+	}
+}
+
+func TestGetVolumeQuota(t *testing.T) {
+	get := "zfs get -H -p -o property,value quota,refquota pool/csi/pvc-1"
+	for output, expected := range map[string]int64{
+		// without -p this quota is shown rounded to 1.50G
+		"quota\t1610612737\nrefquota\t0\n": 1610612737,
+		"quota\t0\nrefquota\t1073741824\n": 1073741824,
+	} {
+		client := &ZfsClient{executor: &fakeExecutor{outputs: map[string]string{get: output}}}
+		quota, err := getVolumeQuota(client, "pool/csi/pvc-1")
+		if err != nil || quota != expected {
+			t.Errorf("expected quota %d for %q, got %d %v", expected, output, quota, err)
+		}
+	}
+
+	client := &ZfsClient{executor: &fakeExecutor{outputs: map[string]string{get: "quota\t0\nrefquota\t0\n"}}}
+	if _, err := getVolumeQuota(client, "pool/csi/pvc-1"); err == nil {
+		t.Errorf("expected an error for a dataset without a quota")
+	}
+}
+
+func TestFindDeletedDataset(t *testing.T) {
+	list := "zfs list -H -p -d 1 -t filesystem,volume -o name,k8s:pv,k8s:namespace,k8s:pvc,k8s:deleted,k8s:deleted-at pool/csi"
+	executor := &fakeExecutor{outputs: map[string]string{
+		list: "pool/csi\t-\t-\t-\t-\t-\n" +
+			"pool/csi/deleted-pvc-1-100\tcitadel/pvc-1\tdefault\tdata\ttrue\t100\n" +
+			"pool/csi/deleted-pvc-2-200\tcitadel/pvc-2\tdefault\tdata\ttrue\t200\n" +
+			"pool/csi/data\tcitadel/pvc-3\tdefault\tdata\ttrue\t-\n" +
+			"pool/csi/pvc-4\tcitadel/pvc-4\tdefault\tdata\t-\t-\n",
+	}}
+	host := &StorageHost{Name: "citadel", ParentDataset: "pool/csi", Client: &ZfsClient{executor: executor}}
+
+	// the dataset without a deletion time, in the property or its name, is never found
+	found, err := findDeletedDataset(host, "", "default", "data")
+	if err != nil || found != "pool/csi/deleted-pvc-2-200" {
+		t.Errorf("expected the most recently deleted dataset, got %q %v", found, err)
+	}
+	found, err = findDeletedDataset(host, "citadel/pvc-3", "", "")
+	if err != nil || found != "" {
+		t.Errorf("expected no dataset with an unknown deletion time, got %q %v", found, err)
+	}
+}
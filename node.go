@@ -7,11 +7,16 @@ import (
 	"log"
 	"net"
 	"os"
+	"os/exec"
 	"path"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
@@ -19,14 +24,13 @@ var _ csi.IdentityServer = (*NodeCsi)(nil)
 var _ csi.NodeServer = (*NodeCsi)(nil)
 
 type NodeConfig struct {
-	NodeHostname    string
-	StorageHostname string
-	ParentDataset   string
+	NodeHostname string
+	Zone         string
 }
 
 type NodeCsi struct {
 	Config *NodeConfig
-	Client *ZfsClient
+	Hosts  StorageHosts
 }
 
 func (*NodeCsi) mountExists(target string) (bool, error) {
@@ -66,22 +70,76 @@ func (*NodeCsi) Probe(context.Context, *csi.ProbeRequest) (*csi.ProbeResponse, e
 }
 
 // NodeExpandVolume implements csi.NodeServer.
-func (*NodeCsi) NodeExpandVolume(context.Context, *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	// this is implemented on the controller side
-	return nil, fmt.Errorf("expansion not supported")
+func (n *NodeCsi) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	log.Printf("NodeExpandVolume: %v", req)
+
+	// the controller grows datasets and zvols, zvols exported over iscsi or nvme-of are rescanned here
+	// so the node sees the new size, and the filesystems created on zvols are grown
+	if err := iscsiRescan(ctx, iscsiTargetIqn(req.VolumeId)); err != nil {
+		log.Printf("Error rescanning iscsi session of volume %s: %v", req.VolumeId, err)
+		return nil, err
+	}
+	if err := nvmeofRescan(ctx, nvmeofSubsystemNqn(req.VolumeId)); err != nil {
+		log.Printf("Error rescanning nvme-of namespace of volume %s: %v", req.VolumeId, err)
+		return nil, err
+	}
+	if req.VolumeCapability.GetBlock() != nil {
+		return &csi.NodeExpandVolumeResponse{CapacityBytes: req.CapacityRange.GetRequiredBytes()}, nil
+	}
+
+	mountpoint := req.StagingTargetPath
+	if mountpoint == "" {
+		mountpoint = req.VolumePath
+	}
+	device, fsType, err := findMount(mountpoint)
+	if err != nil {
+		return nil, err
+	}
+	if device == "" {
+		return nil, status.Errorf(codes.NotFound, "volume %s is not mounted at %s", req.VolumeId, mountpoint)
+	}
+
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		_, err = runNodeCommand(ctx, "resize2fs", device)
+	case FS_TYPE_XFS:
+		_, err = runNodeCommand(ctx, "xfs_growfs", mountpoint)
+	default:
+		// nfs exports and bind mounted datasets already have the new size
+		log.Printf("Nothing to expand for %s filesystem at %s", fsType, mountpoint)
+	}
+	if err != nil {
+		log.Printf("Error growing %s filesystem on %s: %v", fsType, device, err)
+		return nil, err
+	}
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: req.CapacityRange.GetRequiredBytes()}, nil
 }
 
 // NodeGetCapabilities implements csi.NodeServer.
 func (n *NodeCsi) NodeGetCapabilities(context.Context, *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
 	res := &csi.NodeGetCapabilitiesResponse{
 		Capabilities: []*csi.NodeServiceCapability{
-			//{
-			//	Type: &csi.NodeServiceCapability_Rpc{
-			//		Rpc: &csi.NodeServiceCapability_RPC{
-			//			Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
-			//		},
-			//	},
-			//},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
+					},
+				},
+			},
 		},
 	}
 	// log.Printf("NodeGetCapabilities: %v", res)
@@ -90,8 +148,15 @@ func (n *NodeCsi) NodeGetCapabilities(context.Context, *csi.NodeGetCapabilitiesR
 
 // NodeGetInfo implements csi.NodeServer.
 func (n *NodeCsi) NodeGetInfo(context.Context, *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	segments := map[string]string{
+		TOPOLOGY_KEY_HOSTNAME: n.Config.NodeHostname,
+	}
+	if n.Config.Zone != "" {
+		segments[TOPOLOGY_KEY_ZONE] = n.Config.Zone
+	}
 	res := &csi.NodeGetInfoResponse{
-		NodeId: n.Config.NodeHostname,
+		NodeId:             n.Config.NodeHostname,
+		AccessibleTopology: &csi.Topology{Segments: segments},
 	}
 	log.Printf("NodeGetInfo: %v", res)
 	return res, nil
@@ -106,12 +171,20 @@ func (*NodeCsi) NodeGetVolumeStats(context.Context, *csi.NodeGetVolumeStatsReque
 func (n *NodeCsi) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	log.Printf("NodeStageVolume: %v", req)
 
-	if err := os.MkdirAll(req.TargetPath, 0755); err != nil {
+	// block volumes are published as a device node bind mounted on a file instead of a directory
+	block := req.VolumeCapability.GetBlock() != nil
+	if err := createTargetPath(req.TargetPath, block); err != nil {
 		log.Printf("Error creating target path %s: %v", req.TargetPath, err)
 		return nil, err
 	}
 
-	datasetName, err := findExistingDatasetByVolumeId(n.Client, req.VolumeId)
+	host, err := n.Hosts.FromId(req.VolumeId)
+	if err != nil {
+		log.Printf("Error finding storage host of volume ID %s: %v", req.VolumeId, err)
+		return nil, err
+	}
+
+	datasetName, err := findExistingDatasetByVolumeId(host.Client, req.VolumeId)
 	if err != nil {
 		log.Printf("Error finding existing dataset by volume ID %s: %v", req.VolumeId, err)
 		return nil, err
@@ -119,22 +192,63 @@ func (n *NodeCsi) NodePublishVolume(ctx context.Context, req *csi.NodePublishVol
 
 	_, datasetNameDir := path.Split(datasetName)
 
-	if n.Config.StorageHostname == n.Config.NodeHostname {
+	mode := req.VolumeCapability.GetAccessMode().GetMode()
+	readonly := req.Readonly ||
+		mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY ||
+		mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+
+	isStorageNode := host.Hostname == n.Config.NodeHostname
+	protocol := req.VolumeContext[PARAMETER_BLOCK_PROTOCOL]
+	// zvols exported with a block protocol can be used by every node, other zvols only by the storage node
+	exported := protocol != "" && protocol != BLOCK_PROTOCOL_LOCAL
+	if ((block && !exported) || req.VolumeContext[PARAMETER_PLACEMENT] == PLACEMENT_LOCAL) && !isStorageNode {
+		// the scheduler should never place the pod here because of the volume's topology
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s can only be used on the storage node %s", req.VolumeId, host.Hostname)
+	}
+
+	if block {
+		log.Printf("Publishing zvol as a block device")
+		device, err := n.zvolDevice(ctx, host, datasetName, protocol, req.PublishContext)
+		if err != nil {
+			log.Printf("Error getting device of zvol %s: %v", datasetName, err)
+			return nil, err
+		}
+		if err := n.nodePublishVolumeLocal(ctx, device, req.TargetPath, readonly); err != nil {
+			return nil, err
+		}
+	} else if exported {
+		// NodeStageVolume mounted the filesystem of the zvol at the staging path
+		log.Printf("Publishing filesystem of zvol staged at %s", req.StagingTargetPath)
+		if err := n.nodePublishVolumeLocal(ctx, req.StagingTargetPath, req.TargetPath, readonly); err != nil {
+			return nil, err
+		}
+	} else if isStorageNode {
 		log.Printf("Node is storage node, mounting locally")
 		mountpoint := path.Join("/dataset", datasetNameDir)
-		if err := n.nodePublishVolumeLocal(ctx, mountpoint, req.TargetPath); err != nil {
+		if err := n.nodePublishVolumeLocal(ctx, mountpoint, req.TargetPath, readonly); err != nil {
 			return nil, err
 		}
 	} else {
 		log.Printf("Node is not storage node, mounting via NFS")
 
-		mountpoint, err := n.Client.GetDatasetMountpoint(datasetName)
+		mountpoint, err := host.Client.GetDatasetMountpoint(datasetName)
 		if err != nil {
 			log.Printf("Error getting mountpoint for dataset %s: %v", datasetName, err)
 			return nil, err
 		}
 
-		if err := n.nodePublishVolumeNfs(ctx, mountpoint, req.TargetPath); err != nil {
+		if err := n.nodePublishVolumeNfs(ctx, host.Hostname, mountpoint, req.TargetPath, readonly); err != nil {
+			return nil, err
+		}
+	}
+
+	// kubelet doesn't apply the pod's fs group itself because of the VOLUME_MOUNT_GROUP capability
+	if group := req.VolumeCapability.GetMount().GetVolumeMountGroup(); group != "" && !readonly {
+		if !exported && !isSingleNodeAccessMode(mode) {
+			// pods on other nodes may have another fs group, changing the group of the shared dataset would lock them out
+			log.Printf("Not applying volume mount group %s to dataset %s shared with access mode %s", group, datasetName, mode)
+		} else if err := n.applyVolumeMountGroup(host, datasetName, exported, req.TargetPath, group); err != nil {
+			log.Printf("Error applying volume mount group %s to %s: %v", group, req.TargetPath, err)
 			return nil, err
 		}
 	}
@@ -144,7 +258,70 @@ func (n *NodeCsi) NodePublishVolume(ctx context.Context, req *csi.NodePublishVol
 
 // NodeStageVolume implements csi.NodeServer.
 func (n *NodeCsi) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	return nil, fmt.Errorf("staging not supported")
+	log.Printf("NodeStageVolume: %v", req)
+
+	// only exported zvols mounted as a filesystem are staged, everything else is mounted at the target path directly
+	protocol := req.VolumeContext[PARAMETER_BLOCK_PROTOCOL]
+	mount := req.VolumeCapability.GetMount()
+	if protocol == "" || protocol == BLOCK_PROTOCOL_LOCAL || mount == nil {
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	device, _, err := findMount(req.StagingTargetPath)
+	if err != nil {
+		return nil, err
+	}
+	if device != "" {
+		log.Printf("Volume %s is already staged at %s", req.VolumeId, req.StagingTargetPath)
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	host, err := n.Hosts.FromId(req.VolumeId)
+	if err != nil {
+		log.Printf("Error finding storage host of volume ID %s: %v", req.VolumeId, err)
+		return nil, err
+	}
+	datasetName, err := findExistingDatasetByVolumeId(host.Client, req.VolumeId)
+	if err != nil {
+		log.Printf("Error finding existing dataset by volume ID %s: %v", req.VolumeId, err)
+		return nil, err
+	}
+
+	device, err = n.zvolDevice(ctx, host, datasetName, protocol, req.PublishContext)
+	if err != nil {
+		log.Printf("Error getting device of zvol %s: %v", datasetName, err)
+		return nil, err
+	}
+
+	// the fstype of the storage class's csi.storage.k8s.io/fstype parameter takes precedence
+	fsType := mount.FsType
+	if fsType == "" {
+		fsType = req.VolumeContext[PARAMETER_FS_TYPE]
+	}
+	if fsType == "" {
+		fsType = FS_TYPE_EXT4
+	}
+
+	if err := os.MkdirAll(req.StagingTargetPath, 0755); err != nil {
+		log.Printf("Error creating staging path %s: %v", req.StagingTargetPath, err)
+		return nil, err
+	}
+	formatted, err := formatAndMount(ctx, device, req.StagingTargetPath, fsType)
+	if err != nil {
+		log.Printf("Error mounting %s at %s: %v", device, req.StagingTargetPath, err)
+		return nil, err
+	}
+	if formatted {
+		ownership, err := ownershipFromParameters(req.VolumeContext)
+		if err != nil {
+			return nil, err
+		}
+		if err := applyOwnership(req.StagingTargetPath, ownership); err != nil {
+			log.Printf("Error setting ownership of %s: %v", req.StagingTargetPath, err)
+			return nil, err
+		}
+	}
+	return &csi.NodeStageVolumeResponse{}, nil
 }
 
 // NodeUnpublishVolume implements csi.NodeServer.
@@ -166,42 +343,267 @@ func (n *NodeCsi) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublis
 		log.Printf("Target %s is not mounted", req.TargetPath)
 	}
 
+	// the target file of block volumes is created by NodePublishVolume, so it is removed here too
+	if info, err := os.Stat(req.TargetPath); err == nil && info.Mode().IsRegular() {
+		if err := os.Remove(req.TargetPath); err != nil {
+			log.Printf("Error removing %s: %v", req.TargetPath, err)
+			return nil, err
+		}
+	}
+
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
 // NodeUnstageVolume implements csi.NodeServer.
 func (n *NodeCsi) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	return nil, fmt.Errorf("unstaging not supported")
+	log.Printf("NodeUnstageVolume: %v", req)
+
+	device, _, err := findMount(req.StagingTargetPath)
+	if err != nil {
+		return nil, err
+	}
+	if device != "" {
+		if err := syscall.Unmount(req.StagingTargetPath, 0); err != nil {
+			log.Printf("Error unmounting %s: %v", req.StagingTargetPath, err)
+			return nil, err
+		}
+	}
+
+	// block volumes are not mounted at the staging path but still have a session if they were exported
+	if err := iscsiLogout(ctx, iscsiTargetIqn(req.VolumeId)); err != nil {
+		log.Printf("Error logging out of iscsi target of volume %s: %v", req.VolumeId, err)
+		return nil, err
+	}
+	if err := nvmeofDisconnect(ctx, nvmeofSubsystemNqn(req.VolumeId)); err != nil {
+		log.Printf("Error disconnecting from nvme-of subsystem of volume %s: %v", req.VolumeId, err)
+		return nil, err
+	}
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+// create the directory filesystem volumes are mounted on, or the file block volumes are bind mounted on.
+func createTargetPath(target string, block bool) error {
+	if !block {
+		return os.MkdirAll(target, 0755)
+	}
+	if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// get the device of the zvol on this node.
+// the storage node uses the zvol directly, every other node logs in to the export of the zvol.
+func (n *NodeCsi) zvolDevice(ctx context.Context, host *StorageHost, dataset, protocol string, publishContext map[string]string) (string, error) {
+	if host.Hostname == n.Config.NodeHostname {
+		return path.Join("/dev/zvol", dataset), nil
+	}
+	switch protocol {
+	case BLOCK_PROTOCOL_ISCSI:
+		target := publishContext[PUBLISH_CONTEXT_ISCSI_TARGET]
+		if target == "" {
+			return "", status.Errorf(codes.InvalidArgument, "publish context is missing %s", PUBLISH_CONTEXT_ISCSI_TARGET)
+		}
+		return iscsiLogin(ctx, target, host.Hostname, iscsiInitiatorIqn(n.Config.NodeHostname))
+	case BLOCK_PROTOCOL_NVMEOF:
+		nqn := publishContext[PUBLISH_CONTEXT_NVMEOF_SUBSYSTEM]
+		if nqn == "" {
+			return "", status.Errorf(codes.InvalidArgument, "publish context is missing %s", PUBLISH_CONTEXT_NVMEOF_SUBSYSTEM)
+		}
+		return nvmeofConnect(ctx, nqn, host.Hostname, nvmeofHostNqn(n.Config.NodeHostname))
+	}
+	return "", status.Errorf(codes.FailedPrecondition, "zvol %s is not exported to node %s", dataset, n.Config.NodeHostname)
+}
+
+// mount the filesystem on the device, the device is formatted first if it has none.
+// returns true if the filesystem was created.
+func formatAndMount(ctx context.Context, device, target, fsType string) (bool, error) {
+	existing, err := runNodeCommand(ctx, "blkid", "-o", "value", "-s", "TYPE", device)
+	// blkid exits with 2 when the device has no filesystem
+	if err != nil && commandExitCode(err) != 2 {
+		return false, err
+	}
+	formatted := false
+	if existing == "" || err != nil {
+		log.Printf("Creating %s filesystem on %s", fsType, device)
+		if _, err := runNodeCommand(ctx, "mkfs."+fsType, device); err != nil {
+			return false, err
+		}
+		existing = fsType
+		formatted = true
+	} else if existing != fsType {
+		log.Printf("Device %s already has a %s filesystem, mounting it instead of %s", device, existing, fsType)
+	}
+
+	log.Printf("Mounting %s at %s", device, target)
+	return formatted, syscall.Mount(device, target, existing, 0, "")
+}
+
+// set the owner, group and permissions of the mounted filesystem's root directory.
+func applyOwnership(target string, ownership *VolumeOwnership) error {
+	uid, gid := -1, -1
+	if ownership.Uid != "" {
+		uid, _ = strconv.Atoi(ownership.Uid)
+	}
+	if ownership.Gid != "" {
+		gid, _ = strconv.Atoi(ownership.Gid)
+	}
+	if err := os.Lchown(target, uid, gid); err != nil {
+		return err
+	}
+	if ownership.Mode == "" {
+		return nil
+	}
+	mode, _ := strconv.ParseUint(ownership.Mode, 8, 32)
+	// os.Chmod would need the setgid bit as os.ModeSetgid
+	return syscall.Chmod(target, uint32(mode))
+}
+
+// make the volume's root directory writable by the pod's fs group, new files inherit the group through setgid.
+// unlike kubelet only the root directory is changed, not the files already in the volume.
+func (n *NodeCsi) applyVolumeMountGroup(host *StorageHost, dataset string, zvol bool, target, group string) error {
+	if _, err := strconv.ParseUint(group, 10, 32); err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid volume mount group: %s", group)
+	}
+	if !zvol {
+		// nfs exports squash root, so the dataset is changed on the storage host
+		if err := host.Client.ChownDataset(dataset, "", group); err != nil {
+			return err
+		}
+		return host.Client.ChmodDataset(dataset, "g+rwxs")
+	}
+
+	var stat syscall.Stat_t
+	if err := syscall.Stat(target, &stat); err != nil {
+		return err
+	}
+	gid, _ := strconv.Atoi(group)
+	if err := os.Lchown(target, -1, gid); err != nil {
+		return err
+	}
+	return syscall.Chmod(target, stat.Mode&0o7777|0o2070)
+}
+
+// find the device and filesystem type mounted at the target, the device is empty if nothing is mounted there.
+func findMount(target string) (string, string, error) {
+	content, err := os.ReadFile("/proc/mounts")
+	if err != nil {
+		return "", "", errors.New("error reading /proc/mounts")
+	}
+	device, fsType := "", ""
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		// the last mount at the target is the one that is visible
+		if len(fields) >= 3 && fields[1] == target {
+			device, fsType = fields[0], fields[2]
+		}
+	}
+	return device, fsType, nil
 }
 
-func (n *NodeCsi) nodePublishVolumeLocal(ctx context.Context, mountpoint, target string) error {
+func (n *NodeCsi) nodePublishVolumeLocal(ctx context.Context, mountpoint, target string, readonly bool) error {
 	log.Printf("Mounting %s at %s", mountpoint, target)
 	if err := syscall.Mount(mountpoint, target, "", syscall.MS_BIND, ""); err != nil {
 		log.Printf("Error mounting %s: %v", mountpoint, err)
 		return err
 	}
+	if readonly {
+		// the read only flag is ignored when creating a bind mount, it has to be remounted
+		log.Printf("Remounting %s as read only", target)
+		if err := syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+			log.Printf("Error remounting %s as read only: %v", target, err)
+			syscall.Unmount(target, 0)
+			return err
+		}
+	}
 	return nil
 }
 
-func (n *NodeCsi) nodePublishVolumeNfs(ctx context.Context, mountpoint, target string) error {
-	ips, err := net.LookupHost(n.Config.StorageHostname)
+func (n *NodeCsi) nodePublishVolumeNfs(ctx context.Context, storageHostname, mountpoint, target string, readonly bool) error {
+	ips, err := net.LookupHost(storageHostname)
 	if err != nil {
-		log.Printf("Error looking up hostname %s: %v", n.Config.StorageHostname, err)
+		log.Printf("Error looking up hostname %s: %v", storageHostname, err)
 		return err
 	}
 	if len(ips) == 0 {
-		log.Printf("No IPs found for hostname %s", n.Config.StorageHostname)
-		return fmt.Errorf("no IPs found for hostname %s", n.Config.StorageHostname)
+		log.Printf("No IPs found for hostname %s", storageHostname)
+		return fmt.Errorf("no IPs found for hostname %s", storageHostname)
 	}
 	ip := ips[0]
 
 	// https://stackoverflow.com/questions/28350912/nfs-mount-system-call-in-linux
 	source := fmt.Sprintf(":%s", mountpoint)
 	options := fmt.Sprintf("addr=%v", ip)
+	flags := uintptr(0)
+	if readonly {
+		flags |= syscall.MS_RDONLY
+	}
 	log.Printf("Mounting %s at %s with options %s", source, target, options)
-	if err := syscall.Mount(source, target, "nfs4", 0, options); err != nil {
+	if err := syscall.Mount(source, target, "nfs4", flags, options); err != nil {
 		log.Printf("Error mounting %s: %v", source, err)
 		return err
 	}
 	return nil
 }
+
+// run a command on the node, returns its combined output.
+func runNodeCommand(ctx context.Context, name string, args ...string) (string, error) {
+	log.Printf("Running command: %s %s", name, strings.Join(args, " "))
+	output, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	soutput := strings.TrimSpace(string(output))
+	log.Printf("Command output: %s", soutput)
+	if err != nil {
+		return soutput, fmt.Errorf("%s failed: %w: %s", name, err, soutput)
+	}
+	return soutput, nil
+}
+
+// the exit code of a failed runNodeCommand, -1 if the command did not run.
+func commandExitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// how long to wait for the device of a new iscsi session or nvme-of connection to show up
+const DEVICE_TIMEOUT = 30 * time.Second
+
+// wait for the device node to be created by udev.
+func waitForDevice(ctx context.Context, device string, timeout time.Duration) error {
+	err := waitFor(ctx, timeout, func() (bool, error) {
+		_, err := os.Stat(device)
+		return err == nil, nil
+	})
+	if err != nil {
+		return fmt.Errorf("device %s: %v", device, err)
+	}
+	return nil
+}
+
+// poll the check until it is done, returns an error if it fails or isn't done before the timeout.
+func waitFor(ctx context.Context, timeout time.Duration, check func() (bool, error)) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		done, err := check()
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("did not appear after %s", timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	// naming authority of the nqns of the subsystems and hosts created by the driver
+	NVMEOF_NQN_PREFIX = "nqn.2024-01.sh.d464.infra"
+	NVMEOF_PORT       = "4420"
+	// id of the nvmet port the driver creates on the storage host, it listens on every ipv4 address
+	NVMEOF_PORT_ID = "4420"
+	// the zvol is the only namespace of its subsystem
+	NVMEOF_NAMESPACE_ID = "1"
+
+	NVMET_CONFIGFS = "/sys/kernel/config/nvmet"
+
+	// publish context of volumes exported over nvme-of, the nqn of the subsystem the node connects to
+	PUBLISH_CONTEXT_NVMEOF_SUBSYSTEM = "nvmeofSubsystem"
+)
+
+// name of a controller in sysfs and of its character device in /dev
+var nvmeControllerRegex = regexp.MustCompile(`^nvme[0-9]+$`)
+
+// the nqn of the subsystem that exports the volume, both the controller and the node derive it from the volume id.
+func nvmeofSubsystemNqn(volumeId string) string {
+	return fmt.Sprintf("%s:volume.%s", NVMEOF_NQN_PREFIX, exportName(volumeId))
+}
+
+// the nqn the node connects with, the subsystem only allows the nodes the volume is published to.
+func nvmeofHostNqn(nodeId string) string {
+	return fmt.Sprintf("%s:node.%s", NVMEOF_NQN_PREFIX, exportName(nodeId))
+}
+
+// list the entries of a configfs directory, a directory that doesn't exist has none.
+func (z *ZfsClient) listConfigfs(dir string) ([]string, error) {
+	output, err := z.runArgs([]string{"ls", "-1", dir})
+	if err != nil {
+		if strings.Contains(output, "No such file or directory") {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	return strings.Fields(output), nil
+}
+
+// configfs attributes are written through tee since the command can't redirect its output with sudo.
+func (z *ZfsClient) writeConfigfs(file, value string) error {
+	_, err := z.runArgsWithStdin([]string{"tee", file}, value)
+	return err
+}
+
+func (z *ZfsClient) ListNvmeofSubsystems() ([]string, error) {
+	return z.listConfigfs(path.Join(NVMET_CONFIGFS, "subsystems"))
+}
+
+// export the zvol device as the namespace of the subsystem on the driver's tcp port, nothing is changed if it already is.
+func (z *ZfsClient) CreateNvmeofSubsystem(nqn, device string) error {
+	if _, err := z.runArgs([]string{"modprobe", "nvmet-tcp"}); err != nil {
+		return err
+	}
+
+	subsystem := path.Join(NVMET_CONFIGFS, "subsystems", nqn)
+	subsystems, err := z.ListNvmeofSubsystems()
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(subsystems, nqn) {
+		if _, err := z.runArgs([]string{"mkdir", subsystem}); err != nil {
+			return err
+		}
+		// only the hosts in allowed_hosts can connect
+		if err := z.writeConfigfs(path.Join(subsystem, "attr_allow_any_host"), "0"); err != nil {
+			return err
+		}
+	}
+
+	namespace := path.Join(subsystem, "namespaces", NVMEOF_NAMESPACE_ID)
+	namespaces, err := z.listConfigfs(path.Join(subsystem, "namespaces"))
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(namespaces, NVMEOF_NAMESPACE_ID) {
+		if _, err := z.runArgs([]string{"mkdir", namespace}); err != nil {
+			return err
+		}
+		if err := z.writeConfigfs(path.Join(namespace, "device_path"), device); err != nil {
+			return err
+		}
+		if err := z.writeConfigfs(path.Join(namespace, "enable"), "1"); err != nil {
+			return err
+		}
+	}
+
+	port := path.Join(NVMET_CONFIGFS, "ports", NVMEOF_PORT_ID)
+	ports, err := z.listConfigfs(path.Join(NVMET_CONFIGFS, "ports"))
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(ports, NVMEOF_PORT_ID) {
+		// the address of a port can't be changed once a subsystem is linked to it
+		if _, err := z.runArgs([]string{"mkdir", port}); err != nil {
+			return err
+		}
+		for _, attribute := range [][2]string{
+			{"addr_trtype", "tcp"},
+			{"addr_adrfam", "ipv4"},
+			{"addr_traddr", "0.0.0.0"},
+			{"addr_trsvcid", NVMEOF_PORT},
+		} {
+			if err := z.writeConfigfs(path.Join(port, attribute[0]), attribute[1]); err != nil {
+				return err
+			}
+		}
+	}
+
+	linked, err := z.listConfigfs(path.Join(port, "subsystems"))
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(linked, nqn) {
+		if _, err := z.runArgs([]string{"ln", "-s", subsystem, path.Join(port, "subsystems", nqn)}); err != nil {
+			return err
+		}
+	}
+	log.Printf("Exported %s over nvme-of as %s", device, nqn)
+	return nil
+}
+
+// remove the subsystem from the port and delete it, nothing is changed if it doesn't exist.
+func (z *ZfsClient) DeleteNvmeofSubsystem(nqn string) error {
+	subsystems, err := z.ListNvmeofSubsystems()
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(subsystems, nqn) {
+		return nil
+	}
+
+	// a subsystem can only be removed once nothing links to it and it has no namespaces
+	port := path.Join(NVMET_CONFIGFS, "ports", NVMEOF_PORT_ID)
+	linked, err := z.listConfigfs(path.Join(port, "subsystems"))
+	if err != nil {
+		return err
+	}
+	if slices.Contains(linked, nqn) {
+		if _, err := z.runArgs([]string{"rm", path.Join(port, "subsystems", nqn)}); err != nil {
+			return err
+		}
+	}
+
+	hosts, err := z.ListNvmeofHosts(nqn)
+	if err != nil {
+		return err
+	}
+	for _, host := range hosts {
+		if err := z.RemoveNvmeofHost(nqn, host); err != nil {
+			return err
+		}
+	}
+
+	subsystem := path.Join(NVMET_CONFIGFS, "subsystems", nqn)
+	namespaces, err := z.listConfigfs(path.Join(subsystem, "namespaces"))
+	if err != nil {
+		return err
+	}
+	for _, namespace := range namespaces {
+		if _, err := z.runArgs([]string{"rmdir", path.Join(subsystem, "namespaces", namespace)}); err != nil {
+			return err
+		}
+	}
+
+	if _, err := z.runArgs([]string{"rmdir", subsystem}); err != nil {
+		return err
+	}
+	log.Printf("Deleted nvme-of subsystem %s", nqn)
+	return nil
+}
+
+// list the hosts allowed to connect to the subsystem.
+func (z *ZfsClient) ListNvmeofHosts(nqn string) ([]string, error) {
+	return z.listConfigfs(path.Join(NVMET_CONFIGFS, "subsystems", nqn, "allowed_hosts"))
+}
+
+func (z *ZfsClient) AddNvmeofHost(nqn, host string) error {
+	hosts, err := z.ListNvmeofHosts(nqn)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(hosts, host) {
+		return nil
+	}
+
+	// hosts are global, every subsystem the host can connect to links to it
+	hostDir := path.Join(NVMET_CONFIGFS, "hosts", host)
+	allHosts, err := z.listConfigfs(path.Join(NVMET_CONFIGFS, "hosts"))
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(allHosts, host) {
+		if _, err := z.runArgs([]string{"mkdir", hostDir}); err != nil {
+			return err
+		}
+	}
+	_, err = z.runArgs([]string{"ln", "-s", hostDir, path.Join(NVMET_CONFIGFS, "subsystems", nqn, "allowed_hosts", host)})
+	return err
+}
+
+// disallow the host from connecting to the subsystem, the global host entry is kept for the other subsystems.
+func (z *ZfsClient) RemoveNvmeofHost(nqn, host string) error {
+	hosts, err := z.ListNvmeofHosts(nqn)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(hosts, host) {
+		return nil
+	}
+	_, err = z.runArgs([]string{"rm", path.Join(NVMET_CONFIGFS, "subsystems", nqn, "allowed_hosts", host)})
+	return err
+}
+
+// make the subsystem report the new size of the zvol after it was expanded.
+func (z *ZfsClient) RevalidateNvmeofNamespace(nqn string) error {
+	subsystems, err := z.ListNvmeofSubsystems()
+	if err != nil || !slices.Contains(subsystems, nqn) {
+		return err
+	}
+	return z.writeConfigfs(path.Join(NVMET_CONFIGFS, "subsystems", nqn, "namespaces", NVMEOF_NAMESPACE_ID, "revalidate_size"), "1")
+}
+
+// connect to the subsystem with the node's host nqn and wait for the device of its namespace.
+// connecting to a subsystem the node is already connected to only returns the device.
+func nvmeofConnect(ctx context.Context, nqn, storageHostname, hostNqn string) (string, error) {
+	subsystem, err := nvmeofSubsystemPath(nqn)
+	if err != nil {
+		return "", err
+	}
+	if subsystem == "" {
+		ips, err := net.LookupHost(storageHostname)
+		if err != nil {
+			return "", err
+		}
+		if len(ips) == 0 {
+			return "", fmt.Errorf("no IPs found for hostname %s", storageHostname)
+		}
+		if _, err := runNodeCommand(ctx, "nvme", "connect", "-t", "tcp", "-a", ips[0], "-s", NVMEOF_PORT, "-n", nqn, "-q", hostNqn); err != nil {
+			return "", err
+		}
+	}
+
+	var device string
+	if err := waitFor(ctx, DEVICE_TIMEOUT, func() (bool, error) {
+		device, err = nvmeofNamespaceDevice(nqn)
+		return device != "", err
+	}); err != nil {
+		return "", fmt.Errorf("namespace of subsystem %s: %v", nqn, err)
+	}
+	return device, nil
+}
+
+// disconnect from the subsystem, nothing happens if the node is not connected.
+func nvmeofDisconnect(ctx context.Context, nqn string) error {
+	subsystem, err := nvmeofSubsystemPath(nqn)
+	if err != nil || subsystem == "" {
+		return err
+	}
+	_, err = runNodeCommand(ctx, "nvme", "disconnect", "-n", nqn)
+	return err
+}
+
+// make the node pick up the new size of the namespace after the zvol was expanded.
+// ns-rescan works on the character device of a controller, every path to the subsystem is rescanned.
+func nvmeofRescan(ctx context.Context, nqn string) error {
+	controllers, err := nvmeofControllerDevices(nqn)
+	if err != nil {
+		return err
+	}
+	for _, controller := range controllers {
+		if _, err := runNodeCommand(ctx, "nvme", "ns-rescan", controller); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// find the sysfs directory of the node's connection to the subsystem, empty if the node is not connected.
+func nvmeofSubsystemPath(nqn string) (string, error) {
+	paths, err := filepath.Glob("/sys/class/nvme-subsystem/nvme-subsys*/subsysnqn")
+	if err != nil {
+		return "", err
+	}
+	for _, p := range paths {
+		name, err := os.ReadFile(p)
+		if err != nil {
+			return "", err
+		}
+		if strings.TrimSpace(string(name)) == nqn {
+			return filepath.Dir(p), nil
+		}
+	}
+	return "", nil
+}
+
+// find the character devices of the node's controllers of the subsystem, ex: /dev/nvme1, none if the node is not connected.
+func nvmeofControllerDevices(nqn string) ([]string, error) {
+	subsystem, err := nvmeofSubsystemPath(nqn)
+	if err != nil || subsystem == "" {
+		return nil, err
+	}
+	entries, err := os.ReadDir(subsystem)
+	if err != nil {
+		return nil, err
+	}
+	controllers := []string{}
+	for _, entry := range entries {
+		// the subsystem also contains its namespaces, nvme<subsystem>n<namespace>, when native multipath is used
+		if nvmeControllerRegex.MatchString(entry.Name()) {
+			controllers = append(controllers, path.Join("/dev", entry.Name()))
+		}
+	}
+	return controllers, nil
+}
+
+// find the block device of the subsystem's namespace, empty if it doesn't exist yet.
+func nvmeofNamespaceDevice(nqn string) (string, error) {
+	subsystem, err := nvmeofSubsystemPath(nqn)
+	if err != nil || subsystem == "" {
+		return "", err
+	}
+	// with native multipath the namespace is in the subsystem, without it is in the subsystem's controller
+	for _, pattern := range []string{"nvme*n*", "nvme*/nvme*n*"} {
+		namespaces, err := filepath.Glob(filepath.Join(subsystem, pattern))
+		if err != nil {
+			return "", err
+		}
+		if len(namespaces) > 0 {
+			return path.Join("/dev", filepath.Base(namespaces[0])), nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNvmeofNqn(t *testing.T) {
+	if nqn := nvmeofSubsystemNqn("citadel/pvc-1234"); nqn != "nqn.2024-01.sh.d464.infra:volume.citadel-pvc-1234" {
+		t.Errorf("unexpected subsystem nqn %s", nqn)
+	}
+	if nqn := nvmeofHostNqn("worker1"); nqn != "nqn.2024-01.sh.d464.infra:node.worker1" {
+		t.Errorf("unexpected host nqn %s", nqn)
+	}
+}
+
+func TestNvmeofCommands(t *testing.T) {
+	nqn := "nqn.2024-01.sh.d464.infra:volume.citadel-pvc-1"
+	host := "nqn.2024-01.sh.d464.infra:node.worker1"
+	subsystem := NVMET_CONFIGFS + "/subsystems/" + nqn
+	port := NVMET_CONFIGFS + "/ports/" + NVMEOF_PORT_ID
+	runCommandTests(t, []commandTest{
+		{
+			name: "CreateNvmeofSubsystem",
+			run:  func(z *ZfsClient) error { return z.CreateNvmeofSubsystem(nqn, "/dev/zvol/pool/csi/pvc-1") },
+			commands: []string{
+				"modprobe nvmet-tcp",
+				"ls -1 " + NVMET_CONFIGFS + "/subsystems",
+				"mkdir " + subsystem,
+				"tee " + subsystem + "/attr_allow_any_host",
+				"ls -1 " + subsystem + "/namespaces",
+				"mkdir " + subsystem + "/namespaces/1",
+				"tee " + subsystem + "/namespaces/1/device_path",
+				"tee " + subsystem + "/namespaces/1/enable",
+				"ls -1 " + NVMET_CONFIGFS + "/ports",
+				"mkdir " + port,
+				"tee " + port + "/addr_trtype",
+				"tee " + port + "/addr_adrfam",
+				"tee " + port + "/addr_traddr",
+				"tee " + port + "/addr_trsvcid",
+				"ls -1 " + port + "/subsystems",
+				"ln -s " + subsystem + " " + port + "/subsystems/" + nqn,
+			},
+			stdins: []string{"", "", "", "0", "", "", "/dev/zvol/pool/csi/pvc-1", "1", "", "", "tcp", "ipv4", "0.0.0.0", NVMEOF_PORT, "", ""},
+		},
+		{
+			name: "DeleteNvmeofSubsystem",
+			outputs: map[string]string{
+				"ls -1 " + NVMET_CONFIGFS + "/subsystems": nqn,
+				"ls -1 " + port + "/subsystems":           nqn,
+				"ls -1 " + subsystem + "/allowed_hosts":   host,
+				"ls -1 " + subsystem + "/namespaces":      NVMEOF_NAMESPACE_ID,
+			},
+			run: func(z *ZfsClient) error { return z.DeleteNvmeofSubsystem(nqn) },
+			commands: []string{
+				"ls -1 " + NVMET_CONFIGFS + "/subsystems",
+				"ls -1 " + port + "/subsystems",
+				"rm " + port + "/subsystems/" + nqn,
+				"ls -1 " + subsystem + "/allowed_hosts",
+				"ls -1 " + subsystem + "/allowed_hosts",
+				"rm " + subsystem + "/allowed_hosts/" + host,
+				"ls -1 " + subsystem + "/namespaces",
+				"rmdir " + subsystem + "/namespaces/1",
+				"rmdir " + subsystem,
+			},
+		},
+		{
+			name:     "DeleteNvmeofSubsystem that doesn't exist",
+			outputs:  map[string]string{"ls -1 " + NVMET_CONFIGFS + "/subsystems": "ls: cannot access '/sys/kernel/config/nvmet/subsystems': No such file or directory"},
+			errors:   map[string]error{"ls -1 " + NVMET_CONFIGFS + "/subsystems": errors.New("exit status 2")},
+			run:      func(z *ZfsClient) error { return z.DeleteNvmeofSubsystem(nqn) },
+			commands: []string{"ls -1 " + NVMET_CONFIGFS + "/subsystems"},
+		},
+		{
+			name: "ListNvmeofSubsystems",
+			run: func(z *ZfsClient) error {
+				_, err := z.ListNvmeofSubsystems()
+				return err
+			},
+			commands: []string{"ls -1 " + NVMET_CONFIGFS + "/subsystems"},
+		},
+		{
+			name: "ListNvmeofHosts",
+			run: func(z *ZfsClient) error {
+				_, err := z.ListNvmeofHosts(nqn)
+				return err
+			},
+			commands: []string{"ls -1 " + subsystem + "/allowed_hosts"},
+		},
+		{
+			name: "AddNvmeofHost",
+			run:  func(z *ZfsClient) error { return z.AddNvmeofHost(nqn, host) },
+			commands: []string{
+				"ls -1 " + subsystem + "/allowed_hosts",
+				"ls -1 " + NVMET_CONFIGFS + "/hosts",
+				"mkdir " + NVMET_CONFIGFS + "/hosts/" + host,
+				"ln -s " + NVMET_CONFIGFS + "/hosts/" + host + " " + subsystem + "/allowed_hosts/" + host,
+			},
+		},
+		{
+			name:    "RemoveNvmeofHost",
+			outputs: map[string]string{"ls -1 " + subsystem + "/allowed_hosts": host},
+			run:     func(z *ZfsClient) error { return z.RemoveNvmeofHost(nqn, host) },
+			commands: []string{
+				"ls -1 " + subsystem + "/allowed_hosts",
+				"rm " + subsystem + "/allowed_hosts/" + host,
+			},
+		},
+		{
+			name:    "RevalidateNvmeofNamespace",
+			outputs: map[string]string{"ls -1 " + NVMET_CONFIGFS + "/subsystems": nqn},
+			run:     func(z *ZfsClient) error { return z.RevalidateNvmeofNamespace(nqn) },
+			commands: []string{
+				"ls -1 " + NVMET_CONFIGFS + "/subsystems",
+				"tee " + subsystem + "/namespaces/1/revalidate_size",
+			},
+			stdins: []string{"", "1"},
+		},
+	})
+}
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// how the size of the volume is enforced
+	//   quota    - limits the space used by the dataset including its snapshots
+	//   refquota - limits the space referenced by the dataset, snapshots don't count towards the size
+	PARAMETER_QUOTA_MODE = "quotaMode"
+
+	QUOTA_MODE_QUOTA    = "quota"
+	QUOTA_MODE_REFQUOTA = "refquota"
+)
+
+const (
+	// which nodes can access the volume
+	//   any   - every node, the storage node bind mounts the dataset and every other node uses nfs
+	//   zone  - nodes in the same zone as the storage host
+	//   local - only the storage node, pods using the volume are always scheduled there
+	PARAMETER_PLACEMENT = "placement"
+
+	PLACEMENT_ANY   = "any"
+	PLACEMENT_ZONE  = "zone"
+	PLACEMENT_LOCAL = "local"
+)
+
+const (
+	// comma separated list of the parent datasets of the storage host the volume can be created in.
+	// defaults to the dataset configured for the host. with the weighted policy every dataset can have
+	// a weight, ex: `tank/csi=3,fast/csi=1`, datasets without one have a weight of 1.
+	PARAMETER_PARENT_DATASETS = "parentDatasets"
+	// how the parent dataset is picked among the ones with enough available space for the volume
+	//   mostAvailable - the one with the most available space
+	//   roundRobin    - each one in turn
+	//   weighted      - randomly, proportionally to their weights
+	PARAMETER_PARENT_DATASET_POLICY = "parentDatasetPolicy"
+
+	PARENT_DATASET_POLICY_MOST_AVAILABLE = "mostAvailable"
+	PARENT_DATASET_POLICY_ROUND_ROBIN    = "roundRobin"
+	PARENT_DATASET_POLICY_WEIGHTED       = "weighted"
+)
+
+const (
+	// what happens to the dataset when the volume is deleted, stored on the dataset when it is created
+	//   soft     - marked as deleted and renamed, destroyed later by the garbage collector
+	//   snapshot - copied to the archive dataset of the storage host and destroyed
+	//   destroy  - destroyed right away
+	// datasets that still have volume snapshots or clones are always soft deleted.
+	PARAMETER_DELETE_POLICY = "deletePolicy"
+
+	DELETE_POLICY_SOFT     = "soft"
+	DELETE_POLICY_SNAPSHOT = "snapshot"
+	DELETE_POLICY_DESTROY  = "destroy"
+
+	// name of the snapshot copied to the archive dataset by the snapshot delete policy
+	ARCHIVE_SNAPSHOT_NAME = "csi-archive"
+)
+
+const (
+	// how zvols are made available to the nodes, stored on the zvol when it is created
+	//   local  - they aren't, only the storage node can use them
+	//   iscsi  - exported by the lio iscsi target of the storage host
+	//   nvmeof - exported by the nvme-of tcp target of the storage host
+	// volumes with a protocol other than local are zvols even when they are mounted as a filesystem.
+	PARAMETER_BLOCK_PROTOCOL = "blockProtocol"
+
+	BLOCK_PROTOCOL_LOCAL  = "local"
+	BLOCK_PROTOCOL_ISCSI  = "iscsi"
+	BLOCK_PROTOCOL_NVMEOF = "nvmeof"
+
+	// filesystem created on zvols that are mounted as a filesystem, unless the pvc asks for another one
+	PARAMETER_FS_TYPE = "fsType"
+
+	FS_TYPE_EXT4 = "ext4"
+	FS_TYPE_XFS  = "xfs"
+)
+
+const (
+	// encrypt the dataset with zfs native encryption, ex: aes-256-gcm. the key is the
+	// SECRET_ENCRYPTION_KEY of the provisioner secret, it is never stored on the storage host.
+	PARAMETER_ENCRYPTION = "encryption"
+	// the format of the key, passphrase (default) or raw, a raw key is exactly 32 bytes
+	PARAMETER_KEY_FORMAT = "keyFormat"
+
+	ENCRYPTION_OFF        = "off"
+	KEY_FORMAT_PASSPHRASE = "passphrase"
+	KEY_FORMAT_RAW        = "raw"
+
+	// key in the provisioner and controller publish secrets that contains the encryption key
+	SECRET_ENCRYPTION_KEY = "encryptionKey"
+	// optional version of the encryption key, stored on the volume so rotate-keys knows which volumes use an older key
+	SECRET_ENCRYPTION_KEY_VERSION = "encryptionKeyVersion"
+	// the key the volumes were encrypted with before the encryption key was rotated
+	SECRET_PREVIOUS_ENCRYPTION_KEY = "previousEncryptionKey"
+)
+
+var keyVersionRegex = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+var ENCRYPTION_ALGORITHMS = []string{"on", "aes-128-ccm", "aes-192-ccm", "aes-256-ccm", "aes-128-gcm", "aes-192-gcm", "aes-256-gcm"}
+
+const (
+	// numeric owner and group of the root directory of the volume, unset keeps root
+	PARAMETER_UID = "uid"
+	PARAMETER_GID = "gid"
+	// octal permissions of the root directory of the volume, ex: 0770. defaults to DEFAULT_VOLUME_MODE for filesystem datasets
+	PARAMETER_MODE = "mode"
+	// when true new files and directories in the volume inherit the group of its root directory
+	PARAMETER_SETGID = "setgid"
+
+	// only root can write to new volumes unless the ownership parameters or the pod's fs group allow it, 0777 is opt in
+	DEFAULT_VOLUME_MODE = "755"
+)
+
+// the parameters that set the ownership of the volume's root directory, passed to the node in the volume context of zvols
+var OWNERSHIP_PARAMETERS = []string{PARAMETER_UID, PARAMETER_GID, PARAMETER_MODE, PARAMETER_SETGID}
+
+// how long the dataset of a deleted volume is kept before the garbage collector destroys it.
+// overrides STORAGE_GC_RETENTION, accepts go durations, days, ex: 30d, or `forever`.
+const PARAMETER_DELETED_RETENTION = "deletedRetention"
+
+// retention of datasets that are never destroyed
+const RETENTION_FOREVER = "forever"
+
+const (
+	// restore the dataset of a deleted volume instead of creating an empty one.
+	// the deleted volume is selected by its volume id or by the `namespace/name` of its pvc,
+	// if the pvc had several deleted volumes the most recently deleted one is restored.
+	PARAMETER_RESTORE_DELETED_VOLUME_ID = "restoreDeletedVolumeId"
+	PARAMETER_RESTORE_DELETED_PVC       = "restoreDeletedPvc"
+)
+
+// storage class parameters with this prefix are set as zfs properties on the dataset.
+// ex: `zfs.compression: lz4` creates the dataset with `-o compression=lz4`
+const PARAMETER_ZFS_PREFIX = "zfs."
+
+// zfs properties that can be set through storage class parameters and the values they accept
+var ZFS_PARAMETER_PROPERTIES = map[string]func(string) error{
+	"compression":  validateCompression,
+	"recordsize":   validateRecordSize,
+	"atime":        validateOneOf("on", "off"),
+	"xattr":        validateOneOf("on", "off", "sa", "dir"),
+	"logbias":      validateOneOf("latency", "throughput"),
+	"sync":         validateOneOf("standard", "always", "disabled"),
+	"primarycache": validateOneOf("all", "none", "metadata"),
+}
+
+// zfs properties that only exist on filesystems, they are rejected for block volumes
+var ZFS_FILESYSTEM_ONLY_PROPERTIES = []string{"recordsize", "atime", "xattr"}
+
+// block size of the zvols of block volumes, ex: 16K. defaults to the zfs default
+const PARAMETER_VOLBLOCKSIZE = "volblocksize"
+
+var compressionRegex = regexp.MustCompile(`^(on|off|lzjb|zle|lz4|gzip|gzip-[1-9]|zstd|zstd-([1-9]|1[0-9])|zstd-fast|zstd-fast-([1-9]|10|[2-9]0|100|500|1000))$`)
+
+// extract the zfs properties from the storage class parameters.
+// returns an InvalidArgument error for unknown properties or invalid values.
+func zfsPropertiesFromParameters(parameters map[string]string) (map[string]string, error) {
+	properties := map[string]string{}
+	for key, value := range parameters {
+		if !strings.HasPrefix(key, PARAMETER_ZFS_PREFIX) {
+			continue
+		}
+		property := strings.TrimPrefix(key, PARAMETER_ZFS_PREFIX)
+		validate, ok := ZFS_PARAMETER_PROPERTIES[property]
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "unsupported parameter %s, supported zfs properties are: %s", key, strings.Join(supportedZfsParameterProperties(), ", "))
+		}
+		if err := validate(value); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid value for parameter %s: %v", key, err)
+		}
+		properties[property] = value
+	}
+	return properties, nil
+}
+
+// get the quota mode from the parameters, returns the empty string if it is not set.
+func quotaModeFromParameters(parameters map[string]string) (string, error) {
+	mode, ok := parameters[PARAMETER_QUOTA_MODE]
+	if !ok {
+		return "", nil
+	}
+	if err := validateOneOf(QUOTA_MODE_QUOTA, QUOTA_MODE_REFQUOTA)(mode); err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "invalid value for parameter %s: %v", PARAMETER_QUOTA_MODE, err)
+	}
+	return mode, nil
+}
+
+// get the placement from the parameters, defaults to PLACEMENT_ANY.
+func placementFromParameters(parameters map[string]string) (string, error) {
+	placement, ok := parameters[PARAMETER_PLACEMENT]
+	if !ok {
+		return PLACEMENT_ANY, nil
+	}
+	if err := validateOneOf(PLACEMENT_ANY, PLACEMENT_ZONE, PLACEMENT_LOCAL)(placement); err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "invalid value for parameter %s: %v", PARAMETER_PLACEMENT, err)
+	}
+	return placement, nil
+}
+
+type ParentDatasetCandidate struct {
+	Dataset string
+	Weight  int
+}
+
+// get the candidate parent datasets from the parameters, defaults to defaultDataset.
+func parentDatasetsFromParameters(parameters map[string]string, defaultDataset string) ([]ParentDatasetCandidate, error) {
+	value, ok := parameters[PARAMETER_PARENT_DATASETS]
+	if !ok {
+		return []ParentDatasetCandidate{{Dataset: defaultDataset, Weight: 1}}, nil
+	}
+
+	candidates := []ParentDatasetCandidate{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		candidate := ParentDatasetCandidate{Dataset: entry, Weight: 1}
+		if dataset, weight, ok := strings.Cut(entry, "="); ok {
+			w, err := strconv.Atoi(weight)
+			if err != nil || w <= 0 {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid weight for parent dataset %s in parameter %s: '%s' must be a positive integer", dataset, PARAMETER_PARENT_DATASETS, weight)
+			}
+			candidate = ParentDatasetCandidate{Dataset: dataset, Weight: w}
+		}
+		candidate.Dataset = strings.TrimSuffix(candidate.Dataset, "/")
+		if candidate.Dataset == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid value for parameter %s: empty dataset name", PARAMETER_PARENT_DATASETS)
+		}
+		for _, other := range candidates {
+			if isDatasetOrDescendant(candidate.Dataset, other.Dataset) || isDatasetOrDescendant(other.Dataset, candidate.Dataset) {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid value for parameter %s: parent datasets %s and %s overlap", PARAMETER_PARENT_DATASETS, other.Dataset, candidate.Dataset)
+			}
+		}
+		candidates = append(candidates, candidate)
+	}
+	if len(candidates) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "parameter %s must contain at least one dataset", PARAMETER_PARENT_DATASETS)
+	}
+	return candidates, nil
+}
+
+// get the parent dataset policy from the parameters, defaults to PARENT_DATASET_POLICY_MOST_AVAILABLE.
+func parentDatasetPolicyFromParameters(parameters map[string]string) (string, error) {
+	policy, ok := parameters[PARAMETER_PARENT_DATASET_POLICY]
+	if !ok {
+		return PARENT_DATASET_POLICY_MOST_AVAILABLE, nil
+	}
+	if err := validateOneOf(PARENT_DATASET_POLICY_MOST_AVAILABLE, PARENT_DATASET_POLICY_ROUND_ROBIN, PARENT_DATASET_POLICY_WEIGHTED)(policy); err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "invalid value for parameter %s: %v", PARAMETER_PARENT_DATASET_POLICY, err)
+	}
+	return policy, nil
+}
+
+// get the delete policy from the parameters, defaults to DELETE_POLICY_SOFT.
+func deletePolicyFromParameters(parameters map[string]string) (string, error) {
+	policy, ok := parameters[PARAMETER_DELETE_POLICY]
+	if !ok {
+		return DELETE_POLICY_SOFT, nil
+	}
+	if err := validateOneOf(DELETE_POLICY_SOFT, DELETE_POLICY_SNAPSHOT, DELETE_POLICY_DESTROY)(policy); err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "invalid value for parameter %s: %v", PARAMETER_DELETE_POLICY, err)
+	}
+	return policy, nil
+}
+
+// get the zfs properties that encrypt the dataset and its key from the parameters and secrets.
+// returns no properties if encryption is not enabled.
+func encryptionFromParameters(parameters, secrets map[string]string) (map[string]string, string, error) {
+	encryption, ok := parameters[PARAMETER_ENCRYPTION]
+	if !ok || encryption == ENCRYPTION_OFF {
+		return map[string]string{}, "", nil
+	}
+	if err := validateOneOf(ENCRYPTION_ALGORITHMS...)(encryption); err != nil {
+		return nil, "", status.Errorf(codes.InvalidArgument, "invalid value for parameter %s: %v", PARAMETER_ENCRYPTION, err)
+	}
+	keyFormat, ok := parameters[PARAMETER_KEY_FORMAT]
+	if !ok {
+		keyFormat = KEY_FORMAT_PASSPHRASE
+	}
+	if err := validateOneOf(KEY_FORMAT_PASSPHRASE, KEY_FORMAT_RAW)(keyFormat); err != nil {
+		return nil, "", status.Errorf(codes.InvalidArgument, "invalid value for parameter %s: %v", PARAMETER_KEY_FORMAT, err)
+	}
+	key, err := encryptionKeyFromSecrets(secrets, keyFormat)
+	if err != nil {
+		return nil, "", err
+	}
+	properties := map[string]string{
+		ZFS_PROPERTY_ENCRYPTION:  encryption,
+		ZFS_PROPERTY_KEYFORMAT:   keyFormat,
+		ZFS_PROPERTY_KEYLOCATION: ZFS_KEYLOCATION_PROMPT,
+	}
+	version, err := keyVersionFromSecrets(secrets)
+	if err != nil {
+		return nil, "", err
+	}
+	if version != "" {
+		properties[ZFS_PROPERTY_KEY_VERSION] = version
+	}
+	return properties, key, nil
+}
+
+// get the optional version of the encryption key from the secrets, empty if it is not set.
+func keyVersionFromSecrets(secrets map[string]string) (string, error) {
+	version, ok := secrets[SECRET_ENCRYPTION_KEY_VERSION]
+	if !ok {
+		return "", nil
+	}
+	if !keyVersionRegex.MatchString(version) {
+		return "", status.Errorf(codes.InvalidArgument, "secret %s must be 1 to 64 letters, digits, '.', '_' or '-'", SECRET_ENCRYPTION_KEY_VERSION)
+	}
+	return version, nil
+}
+
+// get the encryption key from the secrets and check that zfs accepts it in the key format.
+func encryptionKeyFromSecrets(secrets map[string]string, keyFormat string) (string, error) {
+	key, ok := secrets[SECRET_ENCRYPTION_KEY]
+	if !ok || key == "" {
+		return "", status.Errorf(codes.InvalidArgument, "secret %s must contain the encryption key", SECRET_ENCRYPTION_KEY)
+	}
+	switch keyFormat {
+	case KEY_FORMAT_PASSPHRASE:
+		// zfs reads the passphrase up to the first new line
+		if len(key) < 8 || len(key) > 512 || strings.ContainsAny(key, "\r\n") {
+			return "", status.Errorf(codes.InvalidArgument, "secret %s must be a passphrase of 8 to 512 characters on a single line", SECRET_ENCRYPTION_KEY)
+		}
+	case KEY_FORMAT_RAW:
+		if len(key) != 32 {
+			return "", status.Errorf(codes.InvalidArgument, "secret %s must be a raw key of exactly 32 bytes", SECRET_ENCRYPTION_KEY)
+		}
+	}
+	return key, nil
+}
+
+// get the block protocol from the parameters, defaults to BLOCK_PROTOCOL_LOCAL.
+func blockProtocolFromParameters(parameters map[string]string) (string, error) {
+	protocol, ok := parameters[PARAMETER_BLOCK_PROTOCOL]
+	if !ok {
+		return BLOCK_PROTOCOL_LOCAL, nil
+	}
+	if err := validateOneOf(BLOCK_PROTOCOL_LOCAL, BLOCK_PROTOCOL_ISCSI, BLOCK_PROTOCOL_NVMEOF)(protocol); err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "invalid value for parameter %s: %v", PARAMETER_BLOCK_PROTOCOL, err)
+	}
+	return protocol, nil
+}
+
+// get the filesystem type from the parameters, defaults to FS_TYPE_EXT4.
+func fsTypeFromParameters(parameters map[string]string) (string, error) {
+	fsType, ok := parameters[PARAMETER_FS_TYPE]
+	if !ok {
+		return FS_TYPE_EXT4, nil
+	}
+	if err := validateOneOf(FS_TYPE_EXT4, FS_TYPE_XFS)(fsType); err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "invalid value for parameter %s: %v", PARAMETER_FS_TYPE, err)
+	}
+	return fsType, nil
+}
+
+// get the deleted retention from the parameters, returns the empty string if it is not set.
+func deletedRetentionFromParameters(parameters map[string]string) (string, error) {
+	retention, ok := parameters[PARAMETER_DELETED_RETENTION]
+	if !ok {
+		return "", nil
+	}
+	if _, err := parseRetention(retention); err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "invalid value for parameter %s: %v", PARAMETER_DELETED_RETENTION, err)
+	}
+	return retention, nil
+}
+
+// parse a retention period, returns nil for RETENTION_FOREVER.
+// besides go durations a number of days is accepted, ex: 30d.
+func parseRetention(value string) (*time.Duration, error) {
+	if value == RETENTION_FOREVER {
+		return nil, nil
+	}
+	var retention time.Duration
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.ParseUint(days, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not a valid number of days", value)
+		}
+		retention = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is not a valid duration", value)
+		}
+		retention = d
+	}
+	if retention < 0 {
+		return nil, fmt.Errorf("'%s' cannot be negative", value)
+	}
+	return &retention, nil
+}
+
+// get the deleted volume to restore from the parameters.
+// returns either the volume id or the namespace and name of the pvc, all empty if no volume should be restored.
+func restoreDeletedFromParameters(parameters map[string]string) (volumeId, namespace, pvc string, err error) {
+	volumeId = parameters[PARAMETER_RESTORE_DELETED_VOLUME_ID]
+	restorePvc := parameters[PARAMETER_RESTORE_DELETED_PVC]
+	if volumeId != "" && restorePvc != "" {
+		return "", "", "", status.Errorf(codes.InvalidArgument, "parameters %s and %s cannot be used together", PARAMETER_RESTORE_DELETED_VOLUME_ID, PARAMETER_RESTORE_DELETED_PVC)
+	}
+	if restorePvc != "" {
+		var ok bool
+		namespace, pvc, ok = strings.Cut(restorePvc, "/")
+		if !ok || namespace == "" || pvc == "" || strings.Contains(pvc, "/") {
+			return "", "", "", status.Errorf(codes.InvalidArgument, "invalid value for parameter %s: '%s' must be <namespace>/<name>", PARAMETER_RESTORE_DELETED_PVC, restorePvc)
+		}
+	}
+	return volumeId, namespace, pvc, nil
+}
+
+// owner and permissions of the root directory of a volume
+type VolumeOwnership struct {
+	// empty keeps the owner or group
+	Uid string
+	Gid string
+	// octal permissions including the setgid bit, empty keeps the permissions
+	Mode string
+}
+
+// get the ownership of the volume's root directory from the parameters.
+func ownershipFromParameters(parameters map[string]string) (*VolumeOwnership, error) {
+	ownership := &VolumeOwnership{}
+	for parameter, id := range map[string]*string{PARAMETER_UID: &ownership.Uid, PARAMETER_GID: &ownership.Gid} {
+		value, ok := parameters[parameter]
+		if !ok {
+			continue
+		}
+		if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid value for parameter %s: '%s' is not a numeric id", parameter, value)
+		}
+		*id = value
+	}
+
+	setgid := false
+	if value, ok := parameters[PARAMETER_SETGID]; ok {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid value for parameter %s: %v", PARAMETER_SETGID, err)
+		}
+		setgid = b
+	}
+
+	value, ok := parameters[PARAMETER_MODE]
+	if !ok && !setgid {
+		return ownership, nil
+	}
+	if !ok {
+		value = DEFAULT_VOLUME_MODE
+	}
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0o7777 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid value for parameter %s: '%s' is not an octal mode", PARAMETER_MODE, value)
+	}
+	if setgid {
+		mode |= 0o2000
+	}
+	ownership.Mode = fmt.Sprintf("%o", mode)
+	return ownership, nil
+}
+
+// get the volblocksize from the parameters in bytes, returns 0 if it is not set.
+func volblocksizeFromParameters(parameters map[string]string) (uint64, error) {
+	value, ok := parameters[PARAMETER_VOLBLOCKSIZE]
+	if !ok {
+		return 0, nil
+	}
+	size, err := parseQuota(value)
+	if err != nil || size == nil {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid value for parameter %s: '%s' is not a valid size", PARAMETER_VOLBLOCKSIZE, value)
+	}
+	if *size < 512 || *size > 128*1024 || *size&(*size-1) != 0 {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid value for parameter %s: '%s' must be a power of 2 between 512 and 128K", PARAMETER_VOLBLOCKSIZE, value)
+	}
+	return *size, nil
+}
+
+// check that the zfs properties can be set on a zvol.
+func validateBlockVolumeProperties(properties map[string]string) error {
+	for property := range properties {
+		if slices.Contains(ZFS_FILESYSTEM_ONLY_PROPERTIES, property) {
+			return status.Errorf(codes.InvalidArgument, "parameter %s%s is not supported by block volumes", PARAMETER_ZFS_PREFIX, property)
+		}
+	}
+	return nil
+}
+
+// parameters that can be set in a VolumeAttributesClass and changed after the volume is created.
+// every zfs property supported in storage class parameters is mutable.
+func isMutableParameter(key string) bool {
+	if key == PARAMETER_QUOTA_MODE {
+		return true
+	}
+	_, ok := ZFS_PARAMETER_PROPERTIES[strings.TrimPrefix(key, PARAMETER_ZFS_PREFIX)]
+	return strings.HasPrefix(key, PARAMETER_ZFS_PREFIX) && ok
+}
+
+func validateMutableParameters(parameters map[string]string) error {
+	for key := range parameters {
+		if !isMutableParameter(key) {
+			return status.Errorf(codes.InvalidArgument, "parameter %s is not mutable, mutable parameters are: %s", key, strings.Join(mutableParameters(), ", "))
+		}
+	}
+	if _, err := zfsPropertiesFromParameters(parameters); err != nil {
+		return err
+	}
+	if _, err := quotaModeFromParameters(parameters); err != nil {
+		return err
+	}
+	return nil
+}
+
+func mutableParameters() []string {
+	parameters := []string{PARAMETER_QUOTA_MODE}
+	for _, property := range supportedZfsParameterProperties() {
+		parameters = append(parameters, PARAMETER_ZFS_PREFIX+property)
+	}
+	return parameters
+}
+
+func supportedZfsParameterProperties() []string {
+	properties := []string{}
+	for property := range ZFS_PARAMETER_PROPERTIES {
+		properties = append(properties, property)
+	}
+	sort.Strings(properties)
+	return properties
+}
+
+func validateOneOf(values ...string) func(string) error {
+	return func(value string) error {
+		for _, v := range values {
+			if v == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("'%s' must be one of: %s", value, strings.Join(values, ", "))
+	}
+}
+
+func validateCompression(value string) error {
+	if !compressionRegex.MatchString(value) {
+		return fmt.Errorf("'%s' is not a valid compression algorithm", value)
+	}
+	return nil
+}
+
+func validateRecordSize(value string) error {
+	size, err := parseQuota(value)
+	if err != nil || size == nil {
+		return fmt.Errorf("'%s' is not a valid size", value)
+	}
+	if *size < 512 || *size > 16*1024*1024 || *size&(*size-1) != 0 {
+		return fmt.Errorf("'%s' must be a power of 2 between 512 and 16M", value)
+	}
+	return nil
+}
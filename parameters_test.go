@@ -0,0 +1,259 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestZfsPropertiesFromParameters(t *testing.T) {
+	properties, err := zfsPropertiesFromParameters(map[string]string{
+		"zfs.compression":                  "zstd-3",
+		"zfs.recordsize":                   "1M",
+		"zfs.atime":                        "off",
+		"csi.storage.k8s.io/pvc/name":      "data",
+		"csi.storage.k8s.io/pvc/namespace": "default",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(properties) != 3 || properties["compression"] != "zstd-3" || properties["recordsize"] != "1M" || properties["atime"] != "off" {
+		t.Errorf("unexpected properties: %v", properties)
+	}
+
+	invalid := []map[string]string{
+		{"zfs.mountpoint": "/"},
+		{"zfs.compression": "zstd-20"},
+		{"zfs.compression": "lz4; rm -rf /"},
+		{"zfs.recordsize": "100K"},
+		{"zfs.recordsize": "32M"},
+		{"zfs.recordsize": "big"},
+		{"zfs.sync": "sometimes"},
+	}
+	for _, parameters := range invalid {
+		if _, err := zfsPropertiesFromParameters(parameters); err == nil {
+			t.Errorf("expected an error for %v", parameters)
+		}
+	}
+}
+
+func TestValidateMutableParameters(t *testing.T) {
+	if err := validateMutableParameters(map[string]string{"zfs.compression": "lz4", "quotaMode": "refquota"}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := validateMutableParameters(nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := validateMutableParameters(map[string]string{"snapshotRestoreMode": "copy"}); err == nil {
+		t.Errorf("expected an error for an immutable parameter")
+	}
+	if err := validateMutableParameters(map[string]string{"quotaMode": "both"}); err == nil {
+		t.Errorf("expected an error for an invalid quota mode")
+	}
+}
+
+func TestParentDatasetsFromParameters(t *testing.T) {
+	candidates, err := parentDatasetsFromParameters(map[string]string{}, "blackmesa/csi")
+	if err != nil || len(candidates) != 1 || candidates[0].Dataset != "blackmesa/csi" {
+		t.Errorf("expected the default dataset, got %v %v", candidates, err)
+	}
+
+	candidates, err = parentDatasetsFromParameters(map[string]string{PARAMETER_PARENT_DATASETS: "blackmesa/csi=3, fast/csi/"}, "blackmesa/csi")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(candidates) != 2 || candidates[0] != (ParentDatasetCandidate{"blackmesa/csi", 3}) || candidates[1] != (ParentDatasetCandidate{"fast/csi", 1}) {
+		t.Errorf("unexpected candidates: %v", candidates)
+	}
+
+	invalid := []string{
+		"",
+		"blackmesa/csi=0",
+		"blackmesa/csi=heavy",
+		"blackmesa/csi,blackmesa/csi",
+		"blackmesa/csi,blackmesa/csi/fast",
+		"=2",
+	}
+	for _, value := range invalid {
+		if _, err := parentDatasetsFromParameters(map[string]string{PARAMETER_PARENT_DATASETS: value}, "blackmesa/csi"); err == nil {
+			t.Errorf("expected an error for %q", value)
+		}
+	}
+}
+
+func TestParseRetention(t *testing.T) {
+	cases := map[string]time.Duration{
+		"0":    0,
+		"12h":  12 * time.Hour,
+		"30d":  30 * 24 * time.Hour,
+		"90m":  90 * time.Minute,
+		"1h1s": time.Hour + time.Second,
+	}
+	for value, expected := range cases {
+		retention, err := parseRetention(value)
+		if err != nil || retention == nil || *retention != expected {
+			t.Errorf("expected %s for %s, got %v %v", expected, value, retention, err)
+		}
+	}
+
+	if retention, err := parseRetention(RETENTION_FOREVER); err != nil || retention != nil {
+		t.Errorf("expected no retention for %s, got %v %v", RETENTION_FOREVER, retention, err)
+	}
+
+	for _, value := range []string{"", "-1h", "d", "1.5d", "week"} {
+		if _, err := parseRetention(value); err == nil {
+			t.Errorf("expected an error for %q", value)
+		}
+	}
+}
+
+func TestRestoreDeletedFromParameters(t *testing.T) {
+	volumeId, namespace, pvc, err := restoreDeletedFromParameters(map[string]string{PARAMETER_RESTORE_DELETED_PVC: "default/data"})
+	if err != nil || volumeId != "" || namespace != "default" || pvc != "data" {
+		t.Errorf("unexpected result: %q %q %q %v", volumeId, namespace, pvc, err)
+	}
+
+	volumeId, _, _, err = restoreDeletedFromParameters(map[string]string{PARAMETER_RESTORE_DELETED_VOLUME_ID: "citadel/pvc-1234"})
+	if err != nil || volumeId != "citadel/pvc-1234" {
+		t.Errorf("unexpected result: %q %v", volumeId, err)
+	}
+
+	invalid := []map[string]string{
+		{PARAMETER_RESTORE_DELETED_PVC: "data"},
+		{PARAMETER_RESTORE_DELETED_PVC: "default/"},
+		{PARAMETER_RESTORE_DELETED_PVC: "default/data/1"},
+		{PARAMETER_RESTORE_DELETED_PVC: "default/data", PARAMETER_RESTORE_DELETED_VOLUME_ID: "pvc-1234"},
+	}
+	for _, parameters := range invalid {
+		if _, _, _, err := restoreDeletedFromParameters(parameters); err == nil {
+			t.Errorf("expected an error for %v", parameters)
+		}
+	}
+}
+
+func TestDeletePolicyFromParameters(t *testing.T) {
+	if policy, err := deletePolicyFromParameters(map[string]string{}); err != nil || policy != DELETE_POLICY_SOFT {
+		t.Errorf("expected the soft policy by default, got %q %v", policy, err)
+	}
+	if policy, err := deletePolicyFromParameters(map[string]string{PARAMETER_DELETE_POLICY: DELETE_POLICY_SNAPSHOT}); err != nil || policy != DELETE_POLICY_SNAPSHOT {
+		t.Errorf("expected the snapshot policy, got %q %v", policy, err)
+	}
+	if _, err := deletePolicyFromParameters(map[string]string{PARAMETER_DELETE_POLICY: "shred"}); err == nil {
+		t.Errorf("expected an error for an unknown policy")
+	}
+}
+
+func TestVolblocksizeFromParameters(t *testing.T) {
+	if size, err := volblocksizeFromParameters(map[string]string{}); err != nil || size != 0 {
+		t.Errorf("expected 0 when unset, got %d %v", size, err)
+	}
+	if size, err := volblocksizeFromParameters(map[string]string{PARAMETER_VOLBLOCKSIZE: "16K"}); err != nil || size != 16*1024 {
+		t.Errorf("expected 16K, got %d %v", size, err)
+	}
+	for _, value := range []string{"256", "12K", "1M", "none", "big"} {
+		if _, err := volblocksizeFromParameters(map[string]string{PARAMETER_VOLBLOCKSIZE: value}); err == nil {
+			t.Errorf("expected an error for %s", value)
+		}
+	}
+	if err := validateBlockVolumeProperties(map[string]string{"recordsize": "16K"}); err == nil {
+		t.Errorf("expected an error for a filesystem only property")
+	}
+	if err := validateBlockVolumeProperties(map[string]string{"compression": "lz4"}); err != nil {
+		t.Errorf("unexpected error for compression: %v", err)
+	}
+}
+
+func TestBlockProtocolFromParameters(t *testing.T) {
+	if protocol, err := blockProtocolFromParameters(map[string]string{}); err != nil || protocol != BLOCK_PROTOCOL_LOCAL {
+		t.Errorf("expected the local protocol by default, got %q %v", protocol, err)
+	}
+	if protocol, err := blockProtocolFromParameters(map[string]string{PARAMETER_BLOCK_PROTOCOL: BLOCK_PROTOCOL_ISCSI}); err != nil || protocol != BLOCK_PROTOCOL_ISCSI {
+		t.Errorf("expected the iscsi protocol, got %q %v", protocol, err)
+	}
+	if protocol, err := blockProtocolFromParameters(map[string]string{PARAMETER_BLOCK_PROTOCOL: BLOCK_PROTOCOL_NVMEOF}); err != nil || protocol != BLOCK_PROTOCOL_NVMEOF {
+		t.Errorf("expected the nvmeof protocol, got %q %v", protocol, err)
+	}
+	if _, err := blockProtocolFromParameters(map[string]string{PARAMETER_BLOCK_PROTOCOL: "fc"}); err == nil {
+		t.Errorf("expected an error for an unknown protocol")
+	}
+	if fsType, err := fsTypeFromParameters(map[string]string{}); err != nil || fsType != FS_TYPE_EXT4 {
+		t.Errorf("expected ext4 by default, got %q %v", fsType, err)
+	}
+	if _, err := fsTypeFromParameters(map[string]string{PARAMETER_FS_TYPE: "btrfs"}); err == nil {
+		t.Errorf("expected an error for an unsupported filesystem")
+	}
+}
+
+func TestEncryptionFromParameters(t *testing.T) {
+	properties, key, err := encryptionFromParameters(map[string]string{}, map[string]string{})
+	if err != nil || len(properties) != 0 || key != "" {
+		t.Errorf("expected no encryption by default, got %v %q %v", properties, key, err)
+	}
+
+	passphrase := map[string]string{SECRET_ENCRYPTION_KEY: "correct horse battery staple"}
+	properties, key, err = encryptionFromParameters(map[string]string{PARAMETER_ENCRYPTION: "aes-256-gcm"}, passphrase)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if properties[ZFS_PROPERTY_ENCRYPTION] != "aes-256-gcm" || properties[ZFS_PROPERTY_KEYFORMAT] != KEY_FORMAT_PASSPHRASE || properties[ZFS_PROPERTY_KEYLOCATION] != ZFS_KEYLOCATION_PROMPT {
+		t.Errorf("unexpected properties: %v", properties)
+	}
+	if key != passphrase[SECRET_ENCRYPTION_KEY] {
+		t.Errorf("expected the key from the secret, got %q", key)
+	}
+
+	invalid := []struct {
+		parameters map[string]string
+		secrets    map[string]string
+	}{
+		{map[string]string{PARAMETER_ENCRYPTION: "aes-512-gcm"}, passphrase},
+		{map[string]string{PARAMETER_ENCRYPTION: "on", PARAMETER_KEY_FORMAT: "hex"}, passphrase},
+		{map[string]string{PARAMETER_ENCRYPTION: "on"}, map[string]string{}},
+		{map[string]string{PARAMETER_ENCRYPTION: "on"}, map[string]string{SECRET_ENCRYPTION_KEY: "short"}},
+		{map[string]string{PARAMETER_ENCRYPTION: "on"}, map[string]string{SECRET_ENCRYPTION_KEY: "two\nlines of passphrase"}},
+		{map[string]string{PARAMETER_ENCRYPTION: "on", PARAMETER_KEY_FORMAT: KEY_FORMAT_RAW}, passphrase},
+	}
+	for _, test := range invalid {
+		if _, _, err := encryptionFromParameters(test.parameters, test.secrets); err == nil {
+			t.Errorf("expected an error for %v", test.parameters)
+		}
+	}
+
+	versioned := map[string]string{SECRET_ENCRYPTION_KEY: "correct horse battery staple", SECRET_ENCRYPTION_KEY_VERSION: "1"}
+	if properties, _, err := encryptionFromParameters(map[string]string{PARAMETER_ENCRYPTION: "on"}, versioned); err != nil || properties[ZFS_PROPERTY_KEY_VERSION] != "1" {
+		t.Errorf("expected the key version to be recorded, got %v %v", properties, err)
+	}
+
+	raw := map[string]string{SECRET_ENCRYPTION_KEY: strings.Repeat("k", 32)}
+	if _, _, err := encryptionFromParameters(map[string]string{PARAMETER_ENCRYPTION: "on", PARAMETER_KEY_FORMAT: KEY_FORMAT_RAW}, raw); err != nil {
+		t.Errorf("unexpected error for a raw key: %v", err)
+	}
+}
+
+func TestOwnershipFromParameters(t *testing.T) {
+	ownership, err := ownershipFromParameters(map[string]string{})
+	if err != nil || *ownership != (VolumeOwnership{}) {
+		t.Errorf("expected no ownership by default, got %v %v", ownership, err)
+	}
+
+	ownership, err = ownershipFromParameters(map[string]string{PARAMETER_UID: "1000", PARAMETER_GID: "2000", PARAMETER_MODE: "0770", PARAMETER_SETGID: "true"})
+	if err != nil || *ownership != (VolumeOwnership{Uid: "1000", Gid: "2000", Mode: "2770"}) {
+		t.Errorf("unexpected ownership: %v %v", ownership, err)
+	}
+	ownership, err = ownershipFromParameters(map[string]string{PARAMETER_SETGID: "true"})
+	if err != nil || ownership.Mode != "2755" {
+		t.Errorf("expected setgid on the default mode, got %v %v", ownership, err)
+	}
+
+	for _, parameters := range []map[string]string{
+		{PARAMETER_UID: "-1"},
+		{PARAMETER_GID: "wheel"},
+		{PARAMETER_MODE: "0789"},
+		{PARAMETER_MODE: "17777"},
+		{PARAMETER_SETGID: "yes"},
+	} {
+		if _, err := ownershipFromParameters(parameters); err == nil {
+			t.Errorf("expected an error for %v", parameters)
+		}
+	}
+}
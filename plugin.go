@@ -1,10 +1,19 @@
 package main
 
-import "github.com/container-storage-interface/spec/lib/go/csi"
+import (
+	"slices"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
 
 const (
 	PLUGIN_NAME    = "csi.infra.d464.sh"
 	PLUGIN_VERSION = "1.0.0"
+
+	// topology segments reported by every node
+	TOPOLOGY_KEY_HOSTNAME = PLUGIN_NAME + "/hostname"
+	// only reported when the zone is configured
+	TOPOLOGY_KEY_ZONE = "topology.kubernetes.io/zone"
 )
 
 var PLUGIN_CAPABILITIES = []*csi.PluginCapability{
@@ -22,4 +31,41 @@ var PLUGIN_CAPABILITIES = []*csi.PluginCapability{
 			},
 		},
 	},
+	{
+		// without it the provisioner doesn't pass the accessibility requirements that volume placement depends on
+		Type: &csi.PluginCapability_Service_{
+			Service: &csi.PluginCapability_Service{
+				Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+			},
+		},
+	},
+}
+
+// every access mode is supported since filesystem volumes are exported over nfs to all nodes.
+var SUPPORTED_ACCESS_MODES = []csi.VolumeCapability_AccessMode_Mode{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+}
+
+// zvols can only be used by a single node at a time, whether they are used as a block device or a filesystem.
+var SUPPORTED_BLOCK_ACCESS_MODES = []csi.VolumeCapability_AccessMode_Mode{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+}
+
+// access modes that only allow the volume to be used by one node at a time.
+func isSingleNodeAccessMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	return slices.Contains([]csi.VolumeCapability_AccessMode_Mode{
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+	}, mode)
 }
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// how often the connection is checked, a dead connection is closed so the next command redials
+	SSH_KEEPALIVE_INTERVAL = 30 * time.Second
+	SSH_KEEPALIVE_TIMEOUT  = 15 * time.Second
+	SSH_DIAL_TIMEOUT       = 10 * time.Second
+	// the storage host is redialed this many times with a doubling delay before a command fails
+	SSH_REDIAL_ATTEMPTS = 5
+	SSH_REDIAL_BACKOFF  = time.Second
+	// sessions rejected by the storage host, ex: more than MaxSessions at once, are opened again on the same connection
+	SSH_SESSION_ATTEMPTS = 5
+	SSH_SESSION_BACKOFF  = 100 * time.Millisecond
+)
+
+// read only commands that are retried once when the connection is lost while they run
+var IDEMPOTENT_COMMAND_PREFIXES = []string{"zfs list ", "zfs get ", "zpool list ", "zpool get "}
+
+// runs every command in a new session of the ssh connection, redialing the storage host when the connection is lost
+type SshExecutor struct {
+	dial func() (*ssh.Client, error)
+
+	mutex  sync.Mutex
+	client *ssh.Client
+	// the redial in progress, nil when the connection is not being redialed
+	redial *sshRedial
+}
+
+// commands that lost the connection while it is redialed wait for the result of the same redial
+type sshRedial struct {
+	done   chan struct{}
+	client *ssh.Client
+	err    error
+}
+
+// dial the storage host and keep the connection alive.
+func newSshExecutor(dial func() (*ssh.Client, error)) (*SshExecutor, error) {
+	client, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	go keepalive(client)
+	return &SshExecutor{dial: dial, client: client}, nil
+}
+
+func (e *SshExecutor) Run(command string, stdin io.Reader) (string, error) {
+	client := e.connection()
+	output, started, err := runSession(client, command, stdin)
+	if err == nil || !connectionLost(err) {
+		return output, err
+	}
+
+	log.Printf("Lost connection to storage host: %v", err)
+	client, redialErr := e.reconnect(client)
+	if redialErr != nil {
+		return output, err
+	}
+	// commands that didn't start never read their stdin, commands that did are only run again if it is safe
+	if started && !idempotentCommand(command) {
+		return output, err
+	}
+	log.Printf("Retrying command after reconnecting: %s", command)
+	output, _, err = runSession(client, command, stdin)
+	return output, err
+}
+
+func (e *SshExecutor) connection() *ssh.Client {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.client
+}
+
+// replace the lost connection with a new one, commands that lost the same connection at the same time share the new one.
+// the mutex is not held while dialing, so commands that still have a working connection are not blocked by the redial.
+func (e *SshExecutor) reconnect(lost *ssh.Client) (*ssh.Client, error) {
+	e.mutex.Lock()
+	if e.client != lost {
+		client := e.client
+		e.mutex.Unlock()
+		return client, nil
+	}
+	if redial := e.redial; redial != nil {
+		e.mutex.Unlock()
+		<-redial.done
+		return redial.client, redial.err
+	}
+	redial := &sshRedial{done: make(chan struct{})}
+	e.redial = redial
+	e.mutex.Unlock()
+
+	lost.Close()
+	redial.client, redial.err = e.redialWithBackoff()
+
+	e.mutex.Lock()
+	if redial.err == nil {
+		e.client = redial.client
+	}
+	e.redial = nil
+	e.mutex.Unlock()
+	close(redial.done)
+	return redial.client, redial.err
+}
+
+func (e *SshExecutor) redialWithBackoff() (*ssh.Client, error) {
+	backoff := SSH_REDIAL_BACKOFF
+	var err error
+	for attempt := 1; attempt <= SSH_REDIAL_ATTEMPTS; attempt++ {
+		client, dialErr := e.dial()
+		if dialErr == nil {
+			log.Printf("Reconnected to storage host after %d attempts", attempt)
+			go keepalive(client)
+			return client, nil
+		}
+		err = dialErr
+		log.Printf("Error redialing storage host, attempt %d of %d: %v", attempt, SSH_REDIAL_ATTEMPTS, err)
+		if attempt < SSH_REDIAL_ATTEMPTS {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return nil, err
+}
+
+// run the command in a new session, started is false if the command never reached the storage host.
+func runSession(client *ssh.Client, command string, stdin io.Reader) (string, bool, error) {
+	session, err := openSession(client)
+	if err != nil {
+		log.Printf("Error creating session: %v", err)
+		return "", false, err
+	}
+	defer session.Close()
+	session.Stdin = stdin
+
+	output, err := session.CombinedOutput(command)
+	return string(output), true, err
+}
+
+// open a session, waiting and trying again when the storage host rejects it while the connection still works.
+func openSession(client *ssh.Client) (*ssh.Session, error) {
+	backoff := SSH_SESSION_BACKOFF
+	for attempt := 1; ; attempt++ {
+		session, err := client.NewSession()
+		var rejected *ssh.OpenChannelError
+		if err == nil || !errors.As(err, &rejected) || attempt == SSH_SESSION_ATTEMPTS {
+			return session, err
+		}
+		log.Printf("Storage host rejected session, attempt %d of %d: %v", attempt, SSH_SESSION_ATTEMPTS, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// check if the command failed because the connection was lost, other errors like a rejected session or a command that exited with an error keep the connection.
+func connectionLost(err error) bool {
+	var exitMissing *ssh.ExitMissingError
+	var netError net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || errors.As(err, &exitMissing) || errors.As(err, &netError)
+}
+
+func idempotentCommand(command string) bool {
+	command = strings.TrimPrefix(command, "sudo ")
+	for _, prefix := range IDEMPOTENT_COMMAND_PREFIXES {
+		if strings.HasPrefix(command, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// send keepalives until one fails or gets no reply in time, then close the connection.
+// closing it makes the commands that still wait for it fail instead of hanging on a dead tcp connection.
+func keepalive(client *ssh.Client) {
+	ticker := time.NewTicker(SSH_KEEPALIVE_INTERVAL)
+	defer ticker.Stop()
+	for range ticker.C {
+		reply := make(chan error, 1)
+		go func() {
+			// servers that don't know the request reply with a failure, which still proves the connection works
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+
+		select {
+		case err := <-reply:
+			if err == nil {
+				continue
+			}
+			log.Printf("Keepalive to storage host failed: %v", err)
+		case <-time.After(SSH_KEEPALIVE_TIMEOUT):
+			log.Printf("Keepalive to storage host timed out after %s", SSH_KEEPALIVE_TIMEOUT)
+		}
+		client.Close()
+		return
+	}
+}
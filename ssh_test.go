@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ssh server that answers every command with its command line and can drop connections
+type testSshServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+
+	mutex sync.Mutex
+	conns []net.Conn
+	// commands that drop the connection instead of running, once
+	drop map[string]bool
+	// number of sessions that are rejected like a server at its MaxSessions limit
+	reject int
+}
+
+func newTestSshServer(t *testing.T) *testSshServer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	s := &testSshServer{listener: listener, config: config, drop: map[string]bool{}}
+	go s.serve()
+	return s
+}
+
+func (s *testSshServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.conns = append(s.conns, conn)
+		s.mutex.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *testSshServer) handle(conn net.Conn) {
+	_, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		s.mutex.Lock()
+		reject := s.reject > 0
+		if reject {
+			s.reject--
+		}
+		s.mutex.Unlock()
+		if reject {
+			newChannel.Reject(ssh.Prohibited, "too many sessions")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for request := range channelRequests {
+				if request.Type != "exec" {
+					request.Reply(false, nil)
+					continue
+				}
+				command := string(request.Payload[4:])
+				request.Reply(true, nil)
+
+				s.mutex.Lock()
+				drop := s.drop[command]
+				delete(s.drop, command)
+				s.mutex.Unlock()
+				if drop {
+					conn.Close()
+					return
+				}
+
+				// like a real command, read the stdin before exiting
+				io.ReadAll(channel)
+				channel.Write([]byte(command))
+				status := make([]byte, 4)
+				binary.BigEndian.PutUint32(status, 0)
+				channel.SendRequest("exit-status", false, status)
+				channel.Close()
+			}
+		}()
+	}
+}
+
+// close every connection to the server, like a reboot of the storage host.
+func (s *testSshServer) dropConnections() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testSshServer) dropOnce(command string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.drop[command] = true
+}
+
+func (s *testSshServer) rejectSessions(count int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.reject = count
+}
+
+func newTestSshExecutor(t *testing.T, server *testSshServer) (*SshExecutor, *int) {
+	dials := 0
+	executor, err := newSshExecutor(func() (*ssh.Client, error) {
+		dials++
+		return ssh.Dial("tcp", server.listener.Addr().String(), &ssh.ClientConfig{
+			User:            "test",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { executor.connection().Close() })
+	return executor, &dials
+}
+
+func TestSshExecutorRedials(t *testing.T) {
+	server := newTestSshServer(t)
+	executor, dials := newTestSshExecutor(t, server)
+
+	if output, err := executor.Run("zfs create pool/csi/pvc-1", nil); err != nil || output != "zfs create pool/csi/pvc-1" {
+		t.Fatalf("unexpected output %q %v", output, err)
+	}
+
+	server.dropConnections()
+	executor.connection().Wait()
+	// the command never started on the lost connection, so it runs on the new one even though it is not idempotent
+	if output, err := executor.Run("zfs create pool/csi/pvc-2", strings.NewReader("key")); err != nil || output != "zfs create pool/csi/pvc-2" {
+		t.Fatalf("unexpected output after the connection was lost %q %v", output, err)
+	}
+	if *dials != 2 {
+		t.Errorf("expected 2 dials, got %d", *dials)
+	}
+}
+
+func TestSshExecutorRetriesIdempotentCommands(t *testing.T) {
+	server := newTestSshServer(t)
+	executor, dials := newTestSshExecutor(t, server)
+
+	server.dropOnce("sudo zfs get -H -o value type pool/csi/pvc-1")
+	if output, err := executor.Run("sudo zfs get -H -o value type pool/csi/pvc-1", nil); err != nil || output != "sudo zfs get -H -o value type pool/csi/pvc-1" {
+		t.Fatalf("expected the read to be retried, got %q %v", output, err)
+	}
+
+	server.dropOnce("zfs destroy -r pool/csi/pvc-1")
+	if _, err := executor.Run("zfs destroy -r pool/csi/pvc-1", nil); err == nil {
+		t.Fatalf("expected the interrupted destroy to fail instead of being retried")
+	}
+	// the failed command still reconnected for the next one
+	if _, err := executor.Run("zfs list -H", nil); err != nil {
+		t.Fatalf("unexpected error after the connection was lost: %v", err)
+	}
+	if *dials != 3 {
+		t.Errorf("expected 3 dials, got %d", *dials)
+	}
+}
+
+func TestSshExecutorRetriesRejectedSessions(t *testing.T) {
+	server := newTestSshServer(t)
+	executor, dials := newTestSshExecutor(t, server)
+
+	server.rejectSessions(2)
+	if output, err := executor.Run("zfs destroy -r pool/csi/pvc-1", nil); err != nil || output != "zfs destroy -r pool/csi/pvc-1" {
+		t.Fatalf("expected the rejected session to be opened again, got %q %v", output, err)
+	}
+	// the connection still works, so it is not redialed
+	if *dials != 1 {
+		t.Errorf("expected 1 dial, got %d", *dials)
+	}
+}
+
+func TestSshExecutorRedialDoesNotBlock(t *testing.T) {
+	server := newTestSshServer(t)
+	executor, _ := newTestSshExecutor(t, server)
+	lost := executor.connection()
+
+	dialing := make(chan struct{})
+	release := make(chan struct{})
+	dial := executor.dial
+	executor.dial = func() (*ssh.Client, error) {
+		close(dialing)
+		<-release
+		return dial()
+	}
+	reconnected := make(chan *ssh.Client)
+	go func() {
+		client, err := executor.reconnect(lost)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		reconnected <- client
+	}()
+
+	<-dialing
+	// other commands can still get the connection while the storage host is redialed
+	if executor.connection() != lost {
+		t.Errorf("expected the lost connection while redialing")
+	}
+	close(release)
+	client := <-reconnected
+	if client == lost || executor.connection() != client {
+		t.Errorf("expected the new connection after redialing")
+	}
+	// commands that lost the same connection later use the new one without dialing again
+	if shared, err := executor.reconnect(lost); err != nil || shared != client {
+		t.Errorf("expected the new connection, got %v %v", shared, err)
+	}
+}
+
+func TestConnectionLost(t *testing.T) {
+	for _, test := range []struct {
+		err      error
+		expected bool
+	}{
+		{io.EOF, true},
+		{net.ErrClosed, true},
+		{&ssh.ExitMissingError{}, true},
+		{&net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, true},
+		{&ssh.ExitError{}, false},
+		{&ssh.OpenChannelError{Reason: ssh.Prohibited}, false},
+		{errors.New("ssh: command zfs already started"), false},
+	} {
+		if connectionLost(test.err) != test.expected {
+			t.Errorf("expected connection lost %v for %v", test.expected, test.err)
+		}
+	}
+}
+
+func TestIdempotentCommand(t *testing.T) {
+	for command, expected := range map[string]bool{
+		"zfs list -H -o name":                           true,
+		"sudo zfs get -H -o value type pool/csi":        true,
+		"zpool list -H -o health pool":                  true,
+		"zfs destroy -r pool/csi/pvc-1":                 false,
+		"sudo zfs set k8s:pvc=data pool/csi":            false,
+		"{ zfs send a || echo failed >&2; } | zfs recv": false,
+	} {
+		if idempotentCommand(command) != expected {
+			t.Errorf("expected idempotent %v for %s", expected, command)
+		}
+	}
+}
@@ -2,32 +2,48 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
+	"maps"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
-
-	"golang.org/x/crypto/ssh"
+	"unicode"
 )
 
 type ZfsDatasetInfo struct {
 	name       string
 	mountpoint string
 	quota      *uint64
+	refquota   *uint64
+}
+
+type ZfsSnapshotInfo struct {
+	name       string
+	creation   int64
+	referenced uint64
+	properties map[string]string
 }
 
 type ZfsClient struct {
-	sshClient *ssh.Client
-	sudo      bool
+	executor Executor
+	sudo     bool
 }
 
-func (z *ZfsClient) CreateDataset(name string, properties map[string]string) error {
-	args := []string{}
-	args = append(args, "zfs", "create")
-	for k, v := range properties {
-		args = append(args, fmt.Sprintf("-o %s=%s", k, v))
-	}
+// runs shell commands on the storage host
+type Executor interface {
+	// run the command with the stdin, which can be nil, and return its combined output
+	Run(command string, stdin io.Reader) (string, error)
+}
+
+// create the dataset, the key is written to the stdin of zfs for datasets encrypted with keylocation=prompt.
+// an empty key creates the dataset without stdin.
+func (z *ZfsClient) CreateDataset(name string, properties map[string]string, key string) error {
+	args := []string{"zfs", "create"}
+	args = append(args, propertyArgs(properties)...)
 	args = append(args, name)
-	_, err := z.runArgs(args)
+	_, err := z.runArgsWithKey(args, key)
 	return err
 }
 
@@ -47,11 +63,12 @@ func (z *ZfsClient) RenameDataset(prev, next string) error {
 func (z *ZfsClient) FindDatasetByProperties(properties map[string]string) (string, error) {
 	propertyNames := []string{}
 	propertyNames = append(propertyNames, "name")
-	for key, _ := range properties {
+	// sorted so the command is always the same
+	for _, key := range slices.Sorted(maps.Keys(properties)) {
 		propertyNames = append(propertyNames, key)
 	}
 
-	args := []string{"zfs", "list", "-H", "-t", "filesystem", "-o", strings.Join(propertyNames, ",")}
+	args := []string{"zfs", "list", "-H", "-t", "filesystem,volume", "-o", strings.Join(propertyNames, ",")}
 	output, err := z.runArgs(args)
 	if err != nil {
 		return "", err
@@ -87,7 +104,7 @@ func (z *ZfsClient) FindDatasetByProperties(properties map[string]string) (strin
 	return "", nil
 }
 
-func (z *ZfsClient) CreateDatasetIfNotExists(name string, properties map[string]string) error {
+func (z *ZfsClient) CreateDatasetIfNotExists(name string, properties map[string]string, key string) error {
 	exists, err := z.DatasetExists(name)
 	if err != nil {
 		return err
@@ -97,8 +114,85 @@ func (z *ZfsClient) CreateDatasetIfNotExists(name string, properties map[string]
 		return nil
 	} else {
 		log.Printf("Dataset does not exist, creating: %s", name)
-		return z.CreateDataset(name, properties)
+		return z.CreateDataset(name, properties, key)
+	}
+}
+
+// create a zvol of the given size in bytes, the size must be a multiple of its volblocksize.
+// the key is used like in CreateDataset.
+func (z *ZfsClient) CreateZvol(name string, size uint64, properties map[string]string, key string) error {
+	args := []string{"zfs", "create", "-V", fmt.Sprintf("%d", size)}
+	args = append(args, propertyArgs(properties)...)
+	args = append(args, name)
+	_, err := z.runArgsWithKey(args, key)
+	if err != nil {
+		log.Printf("Error creating zvol %s: %v", name, err)
+		return err
+	}
+	log.Printf("Created zvol %s with size %d", name, size)
+	return nil
+}
+
+func (z *ZfsClient) CreateZvolIfNotExists(name string, size uint64, properties map[string]string, key string) error {
+	exists, err := z.DatasetExists(name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		log.Printf("Zvol already exists, skipping creation: %s", name)
+		return nil
 	}
+	log.Printf("Zvol does not exist, creating: %s", name)
+	return z.CreateZvol(name, size, properties, key)
+}
+
+// load the key of the encrypted dataset, the key is written to the stdin of zfs.
+func (z *ZfsClient) LoadKey(name, key string) error {
+	_, err := z.runArgsWithStdin([]string{"zfs", "load-key", name}, key)
+	if err != nil {
+		log.Printf("Error loading key of %s: %v", name, err)
+		return err
+	}
+	log.Printf("Loaded key of %s", name)
+	return nil
+}
+
+func (z *ZfsClient) UnloadKey(name string) error {
+	_, err := z.runArgs([]string{"zfs", "unload-key", name})
+	return err
+}
+
+// check if the key is the key of the encrypted dataset, it doesn't matter if its key is loaded.
+func (z *ZfsClient) CheckKey(name, key string) (bool, error) {
+	output, err := z.runArgsWithStdin([]string{"zfs", "load-key", "-n", name}, key)
+	if err != nil {
+		if strings.Contains(output, "Incorrect key") {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// replace the key of the encrypted dataset, its current key must be loaded. the new key is written to the stdin of zfs.
+func (z *ZfsClient) ChangeKey(name, key string) error {
+	_, err := z.runArgsWithStdin([]string{"zfs", "change-key", name}, key)
+	if err != nil {
+		log.Printf("Error changing key of %s: %v", name, err)
+		return err
+	}
+	log.Printf("Changed key of %s", name)
+	return nil
+}
+
+func (z *ZfsClient) MountDataset(name string) error {
+	_, err := z.runArgs([]string{"zfs", "mount", name})
+	return err
+}
+
+// get the type of the dataset, either ZFS_TYPE_FILESYSTEM or ZFS_TYPE_VOLUME.
+func (z *ZfsClient) GetDatasetType(name string) (string, error) {
+	return z.GetProperty(name, ZFS_PROPERTY_TYPE)
 }
 
 func (z *ZfsClient) ShareDataset(name string) error {
@@ -111,6 +205,23 @@ func (z *ZfsClient) ShareDataset(name string) error {
 	return err
 }
 
+// change the owner and group of the dataset's root directory, an empty uid or gid is not changed.
+func (z *ZfsClient) ChownDataset(name, uid, gid string) error {
+	if uid == "" && gid == "" {
+		return nil
+	}
+	mountpoint, err := z.GetDatasetMountpoint(name)
+	if err != nil {
+		return err
+	}
+	owner := uid
+	if gid != "" {
+		owner += ":" + gid
+	}
+	_, err = z.runArgs([]string{"chown", owner, mountpoint})
+	return err
+}
+
 func (z *ZfsClient) ChmodDataset(name string, mode string) error {
 	mountpoint, err := z.GetDatasetMountpoint(name)
 	if err != nil {
@@ -139,6 +250,59 @@ func (z *ZfsClient) ListChildDatasets(parent string) ([]ZfsDatasetInfo, error) {
 	return info[1:], nil
 }
 
+// list the given properties of every direct child of the parent with a single command.
+// values are in parsable form (exact numbers), every map also contains the dataset's name.
+// parents can be nested, the volumes of a nested parent are only direct children of that parent and each dataset is listed once.
+func (z *ZfsClient) ListChildDatasetProperties(parents []string, properties []string) ([]map[string]string, error) {
+	propertyNames := []string{"name"}
+	propertyNames = append(propertyNames, properties...)
+
+	args := []string{"zfs", "list", "-H", "-p", "-d", "1", "-t", "filesystem,volume", "-o", strings.Join(propertyNames, ",")}
+	args = append(args, parents...)
+	output, err := z.runArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	datasets := []map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != len(propertyNames) {
+			return nil, fmt.Errorf("zfs list returned invalid number of property values, expected %d but got %d", len(propertyNames), len(fields))
+		}
+		if slices.Contains(parents, fields[0]) || slices.ContainsFunc(datasets, func(dataset map[string]string) bool { return dataset[ZFS_PROPERTY_NAME] == fields[0] }) {
+			continue
+		}
+		dataset := map[string]string{}
+		for i, property := range propertyNames {
+			dataset[property] = fields[i]
+		}
+		datasets = append(datasets, dataset)
+	}
+	return datasets, nil
+}
+
+// list the distinct values of a property across every filesystem and volume of the host, ignoring unset values.
+func (z *ZfsClient) ListPropertyValues(property string) ([]string, error) {
+	args := []string{"zfs", "list", "-H", "-t", "filesystem,volume", "-o", property}
+	output, err := z.runArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	values := []string{}
+	for _, value := range strings.Split(output, "\n") {
+		if value == "" || value == "-" || slices.Contains(values, value) {
+			continue
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
 func (z *ZfsClient) DatasetExists(name string) (bool, error) {
 	datasets, err := z.ListDatasets()
 	if err != nil {
@@ -178,6 +342,51 @@ func (z *ZfsClient) GetProperty(name string, key string) (string, error) {
 	return value, nil
 }
 
+// get the parsable values of multiple properties of the dataset with a single command.
+func (z *ZfsClient) GetProperties(name string, properties []string) (map[string]string, error) {
+	args := []string{"zfs", "get", "-H", "-p", "-o", "property,value", strings.Join(properties, ","), name}
+	output, err := z.runArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	for _, line := range strings.Split(output, "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("zfs get returned invalid line: %s", line)
+		}
+		values[fields[0]] = fields[1]
+	}
+	for _, property := range properties {
+		if _, ok := values[property]; !ok {
+			return nil, fmt.Errorf("property not found: %s/%s", name, property)
+		}
+	}
+	return values, nil
+}
+
+func (z *ZfsClient) GetPoolHealth(pool string) (string, error) {
+	args := []string{"zpool", "list", "-H", "-o", "health", pool}
+	output, err := z.runArgs(args)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(output), nil
+}
+
+// get the exact available space in bytes of the dataset.
+func (z *ZfsClient) GetAvailableSpace(name string) (uint64, error) {
+	args := []string{"zfs", "get", "-H", "-p", "-o", "value", "available", name}
+	output, err := z.runArgs(args)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(output), 10, 64)
+}
+
 func (z *ZfsClient) UpdateProperty(name, key, value string) error {
 	args := []string{"zfs", "set", fmt.Sprintf("%s=%s", key, value), name}
 	_, err := z.runArgs(args)
@@ -186,16 +395,162 @@ func (z *ZfsClient) UpdateProperty(name, key, value string) error {
 
 func (z *ZfsClient) UpdateProperties(name string, properties map[string]string) error {
 	args := []string{"zfs", "set"}
-	for k, v := range properties {
-		args = append(args, fmt.Sprintf("%s=%s", k, v))
+	for _, k := range slices.Sorted(maps.Keys(properties)) {
+		args = append(args, fmt.Sprintf("%s=%s", k, properties[k]))
 	}
 	args = append(args, name)
 	_, err := z.runArgs(args)
 	return err
 }
 
+// remove a property set on the dataset, it goes back to the inherited or default value.
+func (z *ZfsClient) InheritProperty(name, key string) error {
+	args := []string{"zfs", "inherit", key, name}
+	_, err := z.runArgs(args)
+	return err
+}
+
+func (z *ZfsClient) CreateSnapshot(name string, properties map[string]string) error {
+	args := []string{"zfs", "snapshot"}
+	args = append(args, propertyArgs(properties)...)
+	args = append(args, name)
+	_, err := z.runArgs(args)
+	if err != nil {
+		log.Printf("Error creating snapshot %s: %v", name, err)
+		return err
+	}
+	log.Printf("Created snapshot %s", name)
+	return nil
+}
+
+func (z *ZfsClient) DestroySnapshot(name string) error {
+	if !strings.Contains(name, "@") {
+		// zfs destroy also accepts datasets, make sure we never destroy one by accident
+		return fmt.Errorf("not a snapshot name: %s", name)
+	}
+	args := []string{"zfs", "destroy", name}
+	_, err := z.runArgs(args)
+	if err != nil {
+		log.Printf("Error destroying snapshot %s: %v", name, err)
+		return err
+	}
+	log.Printf("Destroyed snapshot %s", name)
+	return nil
+}
+
+// list all snapshots of the parents and their descendants.
+// the given user properties are fetched for every snapshot, unset properties have the value "-".
+func (z *ZfsClient) ListSnapshots(parents []string, properties []string) ([]ZfsSnapshotInfo, error) {
+	propertyNames := []string{"name", "creation", "referenced"}
+	propertyNames = append(propertyNames, properties...)
+
+	// the snapshots of a nested parent are already listed with the parent it is nested in
+	args := []string{"zfs", "list", "-H", "-p", "-r", "-t", "snapshot", "-o", strings.Join(propertyNames, ",")}
+	args = append(args, withoutNestedDatasets(parents)...)
+	output, err := z.runArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := []ZfsSnapshotInfo{}
+	for _, line := range strings.Split(output, "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != len(propertyNames) {
+			return nil, fmt.Errorf("zfs list returned invalid number of property values, expected %d but got %d", len(propertyNames), len(fields))
+		}
+		creation, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			log.Printf("Error parsing creation '%s': %v", fields[1], err)
+			return nil, err
+		}
+		referenced, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			log.Printf("Error parsing referenced '%s': %v", fields[2], err)
+			return nil, err
+		}
+		snapshotProperties := map[string]string{}
+		for i, property := range properties {
+			snapshotProperties[property] = fields[3+i]
+		}
+		snapshots = append(snapshots, ZfsSnapshotInfo{
+			name:       fields[0],
+			creation:   creation,
+			referenced: referenced,
+			properties: snapshotProperties,
+		})
+	}
+	return snapshots, nil
+}
+
+// destroy the dataset together with its snapshots and children.
+func (z *ZfsClient) DestroyDataset(name string) error {
+	if strings.Contains(name, "@") || !strings.Contains(name, "/") {
+		// never destroy a snapshot or a whole pool through here
+		return fmt.Errorf("not a child dataset name: %s", name)
+	}
+	args := []string{"zfs", "destroy", "-r", name}
+	_, err := z.runArgs(args)
+	if err != nil {
+		log.Printf("Error destroying dataset %s: %v", name, err)
+		return err
+	}
+	log.Printf("Destroyed dataset %s", name)
+	return nil
+}
+
+func (z *ZfsClient) CloneSnapshot(snapshot, name string, properties map[string]string) error {
+	args := []string{"zfs", "clone"}
+	args = append(args, propertyArgs(properties)...)
+	args = append(args, snapshot, name)
+	_, err := z.runArgs(args)
+	if err != nil {
+		log.Printf("Error cloning snapshot %s to %s: %v", snapshot, name, err)
+		return err
+	}
+	log.Printf("Cloned snapshot %s to %s", snapshot, name)
+	return nil
+}
+
+func (z *ZfsClient) PromoteDataset(name string) error {
+	args := []string{"zfs", "promote", name}
+	_, err := z.runArgs(args)
+	if err != nil {
+		log.Printf("Error promoting dataset %s: %v", name, err)
+		return err
+	}
+	log.Printf("Promoted dataset %s", name)
+	return nil
+}
+
+// create a new dataset with a full copy of the snapshot's data using zfs send and zfs recv.
+// the received dataset has no dependency on the snapshot.
+// snapshots of encrypted datasets are sent raw, the copy stays encrypted with the key of the source instead of being written in plaintext.
+func (z *ZfsClient) CopySnapshot(snapshot, name string, properties map[string]string) error {
+	encryption, err := z.GetProperties(snapshot, []string{ZFS_PROPERTY_ENCRYPTION_ROOT})
+	if err != nil {
+		return err
+	}
+	send := []string{"zfs", "send", snapshot}
+	if encryption[ZFS_PROPERTY_ENCRYPTION_ROOT] != "-" {
+		send = []string{"zfs", "send", "-w", snapshot}
+	}
+	recv := []string{"zfs", "recv"}
+	recv = append(recv, propertyArgs(properties)...)
+	recv = append(recv, name)
+	_, err = z.runPipeline([][]string{send, recv})
+	if err != nil {
+		log.Printf("Error copying snapshot %s to %s: %v", snapshot, name, err)
+		return err
+	}
+	log.Printf("Copied snapshot %s to %s", snapshot, name)
+	return nil
+}
+
 func (z *ZfsClient) listDatasets(parent string, depth int) ([]ZfsDatasetInfo, error) {
-	args := []string{"zfs", "list", "-H", "-o name,mountpoint,quota"}
+	args := []string{"zfs", "list", "-H", "-o", "name,mountpoint,quota,refquota"}
 	if depth > 0 {
 		args = append(args, "-d", fmt.Sprintf("%d", depth))
 	}
@@ -216,37 +571,127 @@ func (z *ZfsClient) listDatasets(parent string, depth int) ([]ZfsDatasetInfo, er
 			return nil, err
 		}
 
+		refquota, err := parseQuota(fields[3])
+		if err != nil {
+			log.Printf("Error parsing refquota '%s': %v", fields[3], err)
+			return nil, err
+		}
+
 		info = append(info, ZfsDatasetInfo{
 			name:       fields[0],
 			mountpoint: fields[1],
 			quota:      quota,
+			refquota:   refquota,
 		})
 	}
 	return info, nil
 }
 
-func (z *ZfsClient) commandFromArgs(args []string) string {
-	command := strings.Join(args, " ")
+// the -o arguments that set the properties, sorted by property so the command is always the same.
+func propertyArgs(properties map[string]string) []string {
+	args := []string{}
+	for _, k := range slices.Sorted(maps.Keys(properties)) {
+		args = append(args, "-o", k+"="+properties[k])
+	}
+	return args
+}
+
+// characters that never need quoting in a posix shell
+var shellSafeRegex = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// quote the argument for a posix shell, arguments with only safe characters are kept as they are so logged commands stay readable.
+func shellQuote(arg string) string {
+	if shellSafeRegex.MatchString(arg) {
+		return arg
+	}
+	// nothing is special inside single quotes, a single quote ends the quoting and is added escaped
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// build the shell command that runs the args, every arg is quoted so it reaches the program unchanged.
+// args with control characters are rejected, they would break the tab and newline separated output of zfs.
+func (z *ZfsClient) commandFromArgs(args []string) (string, error) {
+	quoted := []string{}
 	if z.sudo {
-		command = "sudo " + command
+		quoted = append(quoted, "sudo")
 	}
-	return command
+	for _, arg := range args {
+		if strings.ContainsFunc(arg, unicode.IsControl) {
+			return "", fmt.Errorf("argument contains control characters: %q", arg)
+		}
+		quoted = append(quoted, shellQuote(arg))
+	}
+	return strings.Join(quoted, " "), nil
 }
 
 func (z *ZfsClient) runArgs(args []string) (string, error) {
-	session, err := z.sshClient.NewSession()
+	return z.runArgsWithReader(args, nil)
+}
+
+// printed to stderr by a stage of a pipeline that fails, followed by the stage number and its exit status
+const PIPELINE_STAGE_FAILED = "pipeline stage failed:"
+
+// run every stage with its stdout piped into the next stage's stdin.
+// the exit status of a pipeline is the one of its last stage and pipefail is not posix,
+// so the other stages report their failure on stderr and the pipeline fails if any of them did.
+func (z *ZfsClient) runPipeline(stages [][]string) (string, error) {
+	commands := []string{}
+	for i, stage := range stages {
+		command, err := z.commandFromArgs(stage)
+		if err != nil {
+			return "", err
+		}
+		if i < len(stages)-1 {
+			command = fmt.Sprintf(`{ %s || echo "%s %d $?" >&2; }`, command, PIPELINE_STAGE_FAILED, i+1)
+		}
+		commands = append(commands, command)
+	}
+	output, err := z.runCommandWithStdin(strings.Join(commands, " | "), nil)
+	if err == nil && strings.Contains(output, PIPELINE_STAGE_FAILED) {
+		return output, fmt.Errorf("error running pipeline: %s", output)
+	}
+	return output, err
+}
+
+// run the command with the input written to its stdin, it is never logged so it can contain secrets.
+func (z *ZfsClient) runArgsWithStdin(args []string, stdin string) (string, error) {
+	return z.runArgsWithReader(args, strings.NewReader(stdin))
+}
+
+func (z *ZfsClient) runArgsWithReader(args []string, stdin io.Reader) (string, error) {
+	command, err := z.commandFromArgs(args)
 	if err != nil {
-		log.Printf("Error creating session: %v", err)
 		return "", err
 	}
-	defer session.Close()
+	return z.runCommandWithStdin(command, stdin)
+}
 
-	command := z.commandFromArgs(args)
+// run the command with the key as its stdin, or without stdin if there is no key.
+func (z *ZfsClient) runArgsWithKey(args []string, key string) (string, error) {
+	if key == "" {
+		return z.runArgs(args)
+	}
+	return z.runArgsWithStdin(args, key)
+}
+
+func (z *ZfsClient) runCommandWithStdin(command string, stdin io.Reader) (string, error) {
 	log.Printf("Running command: %s", command)
-	output, err := session.CombinedOutput(command)
-	soutput := strings.TrimSpace(string(output))
-	log.Printf("Command output: %s", soutput)
-	return soutput, err
+	output, err := z.executor.Run(command, stdin)
+	// only the new lines are trimmed, an empty last value of tab separated output ends with a tab
+	output = strings.TrimRight(output, "\r\n")
+	log.Printf("Command output: %s", output)
+	return output, err
+}
+
+// drop the datasets that are descendants of another dataset of the list, and duplicates.
+func withoutNestedDatasets(datasets []string) []string {
+	outer := []string{}
+	for _, dataset := range datasets {
+		if !slices.ContainsFunc(datasets, func(other string) bool { return other != dataset && isDatasetOrDescendant(dataset, other) }) && !slices.Contains(outer, dataset) {
+			outer = append(outer, dataset)
+		}
+	}
+	return outer
 }
 
 func parseQuota(quota string) (*uint64, error) {
@@ -1,6 +1,12 @@
 package main
 
-import "testing"
+import (
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
 
 func TestParseQuota(t *testing.T) {
 	var v *uint64
@@ -26,3 +32,457 @@ func TestParseQuota(t *testing.T) {
 		t.Errorf("failed to parse - %v", err)
 	}
 }
+
+// records the commands run by a ZfsClient and answers them with canned output
+type fakeExecutor struct {
+	// output and error by command line, other commands succeed without output
+	outputs  map[string]string
+	errors   map[string]error
+	commands []string
+	stdins   []string
+}
+
+func (e *fakeExecutor) Run(command string, stdin io.Reader) (string, error) {
+	e.commands = append(e.commands, command)
+	input := ""
+	if stdin != nil {
+		b, err := io.ReadAll(stdin)
+		if err != nil {
+			return "", err
+		}
+		input = string(b)
+	}
+	e.stdins = append(e.stdins, input)
+	return e.outputs[command], e.errors[command]
+}
+
+type commandTest struct {
+	name    string
+	sudo    bool
+	outputs map[string]string
+	errors  map[string]error
+	run     func(z *ZfsClient) error
+	// the exact command lines, in order
+	commands []string
+	// the stdin of every command, not checked if nil
+	stdins []string
+}
+
+func runCommandTests(t *testing.T, tests []commandTest) {
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			executor := &fakeExecutor{outputs: test.outputs, errors: test.errors}
+			z := &ZfsClient{executor: executor, sudo: test.sudo}
+			if err := test.run(z); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !slices.Equal(executor.commands, test.commands) {
+				t.Errorf("expected commands:\n%s\ngot:\n%s", strings.Join(test.commands, "\n"), strings.Join(executor.commands, "\n"))
+			}
+			if test.stdins != nil && !slices.Equal(executor.stdins, test.stdins) {
+				t.Errorf("expected stdins %q, got %q", test.stdins, executor.stdins)
+			}
+		})
+	}
+}
+
+const testListDatasets = "zfs list -H -o name,mountpoint,quota,refquota"
+
+var testDatasetOutputs = map[string]string{
+	testListDatasets: "pool/csi\t/pool/csi\tnone\tnone\npool/csi/pvc-1\t/pool/csi/pvc-1\t10G\tnone",
+}
+
+func TestShellQuote(t *testing.T) {
+	for arg, expected := range map[string]string{
+		"pool/csi/pvc-1":           "pool/csi/pvc-1",
+		"k8s:pvc=data-0":           "k8s:pvc=data-0",
+		"rw=@10.0.0.1/32":          "rw=@10.0.0.1/32",
+		"":                         "''",
+		"my pvc":                   "'my pvc'",
+		"$(reboot)":                "'$(reboot)'",
+		"a;b|c&d>e":                "'a;b|c&d>e'",
+		"it's":                     `'it'\''s'`,
+		"~root":                    "'~root'",
+		"*":                        "'*'",
+		"k8s:pvc=`id`":             "'k8s:pvc=`id`'",
+		"k8s:namespace=\"quoted\"": `'k8s:namespace="quoted"'`,
+	} {
+		if quoted := shellQuote(arg); quoted != expected {
+			t.Errorf("expected %q to be quoted as %s, got %s", arg, expected, quoted)
+		}
+	}
+}
+
+func TestCommandFromArgs(t *testing.T) {
+	z := &ZfsClient{sudo: true}
+	command, err := z.commandFromArgs([]string{"zfs", "set", "k8s:pvc=my pvc", "pool/csi/pvc-1"})
+	if err != nil || command != "sudo zfs set 'k8s:pvc=my pvc' pool/csi/pvc-1" {
+		t.Errorf("unexpected command %s %v", command, err)
+	}
+	for _, arg := range []string{"a\nb", "a\tb", "a\x00b", "a\x7fb", "a\rb"} {
+		if _, err := z.commandFromArgs([]string{"zfs", "set", arg}); err == nil {
+			t.Errorf("expected an error for %q", arg)
+		}
+	}
+
+	// nothing runs when an argument is rejected
+	executor := &fakeExecutor{}
+	z = &ZfsClient{executor: executor}
+	if err := z.UpdateProperty("pool/csi/pvc-1", ZFS_PROPERTY_PVC, "data\nrm -rf /"); err == nil {
+		t.Errorf("expected an error for a value with a new line")
+	}
+	get := "zfs get -H -p -o property,value encryptionroot pool/csi/pvc-1@snap"
+	executor.outputs = map[string]string{get: "encryptionroot\t-\n"}
+	if err := z.CopySnapshot("pool/csi/pvc-1@snap", "pool/csi/pvc-2", map[string]string{ZFS_PROPERTY_PVC: "a\x1bb"}); err == nil {
+		t.Errorf("expected an error for a pipeline with a control character")
+	}
+	// only the encryption of the snapshot was read before the pipeline was rejected
+	if !slices.Equal(executor.commands, []string{get}) {
+		t.Errorf("expected no commands besides %s, got %v", get, executor.commands)
+	}
+}
+
+func TestRunPipeline(t *testing.T) {
+	pipeline := `{ zfs send pool/csi/pvc-1@snap || echo "pipeline stage failed: 1 $?" >&2; } | zfs recv pool/csi/pvc-2`
+	// the exit status is the one of the last stage, only the output shows that another stage failed
+	executor := &fakeExecutor{outputs: map[string]string{pipeline: "cannot open 'pool/csi/pvc-1@snap': dataset does not exist\npipeline stage failed: 1 1"}}
+	z := &ZfsClient{executor: executor}
+	if _, err := z.runPipeline([][]string{{"zfs", "send", "pool/csi/pvc-1@snap"}, {"zfs", "recv", "pool/csi/pvc-2"}}); err == nil {
+		t.Errorf("expected an error when a stage before the last one fails")
+	}
+
+	executor.outputs[pipeline] = ""
+	if _, err := z.runPipeline([][]string{{"zfs", "send", "pool/csi/pvc-1@snap"}, {"zfs", "recv", "pool/csi/pvc-2"}}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestListChildDatasetPropertiesNested(t *testing.T) {
+	list := "zfs list -H -p -d 1 -t filesystem,volume -o name,k8s:pv pool/csi pool/csi/fast"
+	// pool/csi/fast is both a child of pool/csi and a parent
+	executor := &fakeExecutor{outputs: map[string]string{list: "pool/csi\t-\npool/csi/fast\t-\npool/csi/pvc-1\tcitadel/pvc-1\npool/csi/fast\t-\npool/csi/fast/pvc-2\tcitadel/pvc-2\npool/csi/fast/pvc-2\tcitadel/pvc-2\n"}}
+	z := &ZfsClient{executor: executor}
+	datasets, err := z.ListChildDatasetProperties([]string{"pool/csi", "pool/csi/fast"}, []string{ZFS_PROPERTY_PV})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	names := []string{}
+	for _, dataset := range datasets {
+		names = append(names, dataset[ZFS_PROPERTY_NAME])
+	}
+	if !slices.Equal(names, []string{"pool/csi/pvc-1", "pool/csi/fast/pvc-2"}) {
+		t.Errorf("expected every volume once, got %v", names)
+	}
+}
+
+func TestZfsClientCommands(t *testing.T) {
+	runCommandTests(t, []commandTest{
+		{
+			name: "CreateDataset",
+			run: func(z *ZfsClient) error {
+				return z.CreateDataset("pool/csi/pvc-1", map[string]string{ZFS_PROPERTY_PVC: "my data", "compression": "lz4"}, "")
+			},
+			commands: []string{"zfs create -o compression=lz4 -o 'k8s:pvc=my data' pool/csi/pvc-1"},
+			stdins:   []string{""},
+		},
+		{
+			name: "CreateDataset with sudo and key",
+			sudo: true,
+			run: func(z *ZfsClient) error {
+				return z.CreateDataset("pool/csi/pvc-1", map[string]string{ZFS_PROPERTY_ENCRYPTION: "on"}, "correct horse battery staple")
+			},
+			commands: []string{"sudo zfs create -o encryption=on pool/csi/pvc-1"},
+			stdins:   []string{"correct horse battery staple"},
+		},
+		{
+			name:     "RenameDataset",
+			run:      func(z *ZfsClient) error { return z.RenameDataset("pool/csi/pvc-1", "pool/archive/pvc-1") },
+			commands: []string{"zfs rename pool/csi/pvc-1 pool/archive/pvc-1"},
+		},
+		{
+			name:    "FindDatasetByProperties",
+			outputs: map[string]string{"zfs list -H -t filesystem,volume -o name,k8s:deleted,k8s:pvc": "pool/csi/pvc-1\tfalse\tdata"},
+			run: func(z *ZfsClient) error {
+				name, err := z.FindDatasetByProperties(map[string]string{ZFS_PROPERTY_PVC: "data", ZFS_PROPERTY_DELETED: "false"})
+				if err == nil && name != "pool/csi/pvc-1" {
+					return errors.New("dataset not found: " + name)
+				}
+				return err
+			},
+			commands: []string{"zfs list -H -t filesystem,volume -o name,k8s:deleted,k8s:pvc"},
+		},
+		{
+			name:     "CreateDatasetIfNotExists",
+			outputs:  testDatasetOutputs,
+			run:      func(z *ZfsClient) error { return z.CreateDatasetIfNotExists("pool/csi/pvc-2", map[string]string{}, "") },
+			commands: []string{testListDatasets, "zfs create pool/csi/pvc-2"},
+		},
+		{
+			name: "CreateZvol",
+			run: func(z *ZfsClient) error {
+				return z.CreateZvol("pool/csi/pvc-2", 1073741824, map[string]string{ZFS_PROPERTY_VOLBLOCKSIZE: "16384"}, "")
+			},
+			commands: []string{"zfs create -V 1073741824 -o volblocksize=16384 pool/csi/pvc-2"},
+		},
+		{
+			name:    "CreateZvolIfNotExists",
+			outputs: testDatasetOutputs,
+			run: func(z *ZfsClient) error {
+				return z.CreateZvolIfNotExists("pool/csi/pvc-1", 1073741824, map[string]string{}, "")
+			},
+			commands: []string{testListDatasets},
+		},
+		{
+			name:     "LoadKey",
+			run:      func(z *ZfsClient) error { return z.LoadKey("pool/csi/pvc-1", "correct horse battery staple") },
+			commands: []string{"zfs load-key pool/csi/pvc-1"},
+			stdins:   []string{"correct horse battery staple"},
+		},
+		{
+			name:     "UnloadKey",
+			run:      func(z *ZfsClient) error { return z.UnloadKey("pool/csi/pvc-1") },
+			commands: []string{"zfs unload-key pool/csi/pvc-1"},
+		},
+		{
+			name:    "CheckKey",
+			outputs: map[string]string{"zfs load-key -n pool/csi/pvc-1": "Key load error: Incorrect key provided for 'pool/csi/pvc-1'."},
+			errors:  map[string]error{"zfs load-key -n pool/csi/pvc-1": errors.New("exit status 255")},
+			run: func(z *ZfsClient) error {
+				ok, err := z.CheckKey("pool/csi/pvc-1", "hunter2hunter2")
+				if err == nil && ok {
+					return errors.New("expected an incorrect key")
+				}
+				return err
+			},
+			commands: []string{"zfs load-key -n pool/csi/pvc-1"},
+			stdins:   []string{"hunter2hunter2"},
+		},
+		{
+			name:     "ChangeKey",
+			run:      func(z *ZfsClient) error { return z.ChangeKey("pool/csi/pvc-1", "correct horse battery staple") },
+			commands: []string{"zfs change-key pool/csi/pvc-1"},
+			stdins:   []string{"correct horse battery staple"},
+		},
+		{
+			name:     "MountDataset",
+			run:      func(z *ZfsClient) error { return z.MountDataset("pool/csi/pvc-1") },
+			commands: []string{"zfs mount pool/csi/pvc-1"},
+		},
+		{
+			name:    "GetDatasetType",
+			outputs: map[string]string{"zfs get -H -o value type pool/csi/pvc-1": "filesystem"},
+			run: func(z *ZfsClient) error {
+				_, err := z.GetDatasetType("pool/csi/pvc-1")
+				return err
+			},
+			commands: []string{"zfs get -H -o value type pool/csi/pvc-1"},
+		},
+		{
+			name:     "ShareDataset",
+			run:      func(z *ZfsClient) error { return z.ShareDataset("pool/csi/pvc-1") },
+			commands: []string{"zfs share pool/csi/pvc-1"},
+		},
+		{
+			name:     "ChownDataset",
+			outputs:  testDatasetOutputs,
+			run:      func(z *ZfsClient) error { return z.ChownDataset("pool/csi/pvc-1", "1000", "2000") },
+			commands: []string{testListDatasets, "chown 1000:2000 /pool/csi/pvc-1"},
+		},
+		{
+			name:     "ChownDataset group only",
+			outputs:  testDatasetOutputs,
+			run:      func(z *ZfsClient) error { return z.ChownDataset("pool/csi/pvc-1", "", "2000") },
+			commands: []string{testListDatasets, "chown :2000 /pool/csi/pvc-1"},
+		},
+		{
+			name:     "ChmodDataset",
+			outputs:  testDatasetOutputs,
+			run:      func(z *ZfsClient) error { return z.ChmodDataset("pool/csi/pvc-1", "g+rwxs") },
+			commands: []string{testListDatasets, "chmod g+rwxs /pool/csi/pvc-1"},
+		},
+		{
+			name:     "SetDatasetQuota",
+			run:      func(z *ZfsClient) error { return z.SetDatasetQuota("pool/csi/pvc-1", 1073741824) },
+			commands: []string{"zfs set quota=1073741824 pool/csi/pvc-1"},
+		},
+		{
+			name:    "ListDatasets",
+			outputs: testDatasetOutputs,
+			run: func(z *ZfsClient) error {
+				_, err := z.ListDatasets()
+				return err
+			},
+			commands: []string{testListDatasets},
+		},
+		{
+			name:    "ListChildDatasets",
+			outputs: map[string]string{testListDatasets + " -d 1 pool/csi": testDatasetOutputs[testListDatasets]},
+			run: func(z *ZfsClient) error {
+				_, err := z.ListChildDatasets("pool/csi")
+				return err
+			},
+			commands: []string{testListDatasets + " -d 1 pool/csi"},
+		},
+		{
+			name: "ListChildDatasetProperties",
+			run: func(z *ZfsClient) error {
+				_, err := z.ListChildDatasetProperties([]string{"pool/csi", "tank/csi"}, []string{ZFS_PROPERTY_PV, ZFS_PROPERTY_USED})
+				return err
+			},
+			commands: []string{"zfs list -H -p -d 1 -t filesystem,volume -o name,k8s:pv,used pool/csi tank/csi"},
+		},
+		{
+			name: "ListPropertyValues",
+			run: func(z *ZfsClient) error {
+				_, err := z.ListPropertyValues(ZFS_PROPERTY_PARENT_DATASET)
+				return err
+			},
+			commands: []string{"zfs list -H -t filesystem,volume -o k8s:parent-dataset"},
+		},
+		{
+			name:    "DatasetExists",
+			outputs: testDatasetOutputs,
+			run: func(z *ZfsClient) error {
+				_, err := z.DatasetExists("pool/csi/pvc-1")
+				return err
+			},
+			commands: []string{testListDatasets},
+		},
+		{
+			name:    "GetDatasetMountpoint",
+			outputs: testDatasetOutputs,
+			run: func(z *ZfsClient) error {
+				_, err := z.GetDatasetMountpoint("pool/csi/pvc-1")
+				return err
+			},
+			commands: []string{testListDatasets},
+		},
+		{
+			name:    "GetProperty",
+			outputs: map[string]string{"zfs get -H -o value k8s:pvc pool/csi/pvc-1": "data"},
+			run: func(z *ZfsClient) error {
+				_, err := z.GetProperty("pool/csi/pvc-1", ZFS_PROPERTY_PVC)
+				return err
+			},
+			commands: []string{"zfs get -H -o value k8s:pvc pool/csi/pvc-1"},
+		},
+		{
+			name:    "GetProperties",
+			outputs: map[string]string{"zfs get -H -p -o property,value keystatus,mounted pool/csi/pvc-1": "keystatus\tavailable\nmounted\tyes"},
+			run: func(z *ZfsClient) error {
+				_, err := z.GetProperties("pool/csi/pvc-1", []string{ZFS_PROPERTY_KEYSTATUS, ZFS_PROPERTY_MOUNTED})
+				return err
+			},
+			commands: []string{"zfs get -H -p -o property,value keystatus,mounted pool/csi/pvc-1"},
+		},
+		{
+			name: "GetPoolHealth",
+			run: func(z *ZfsClient) error {
+				_, err := z.GetPoolHealth("pool")
+				return err
+			},
+			commands: []string{"zpool list -H -o health pool"},
+		},
+		{
+			name:    "GetAvailableSpace",
+			outputs: map[string]string{"zfs get -H -p -o value available pool/csi": "1024"},
+			run: func(z *ZfsClient) error {
+				_, err := z.GetAvailableSpace("pool/csi")
+				return err
+			},
+			commands: []string{"zfs get -H -p -o value available pool/csi"},
+		},
+		{
+			name: "UpdateProperty",
+			run: func(z *ZfsClient) error {
+				return z.UpdateProperty("pool/csi/pvc-1", ZFS_PROPERTY_PVC, "it's; rm -rf /")
+			},
+			commands: []string{`zfs set 'k8s:pvc=it'\''s; rm -rf /' pool/csi/pvc-1`},
+		},
+		{
+			name: "UpdateProperties",
+			run: func(z *ZfsClient) error {
+				return z.UpdateProperties("pool/csi/pvc-1", map[string]string{ZFS_PROPERTY_SHARENFS: "rw=@10.0.0.1/32", ZFS_PROPERTY_PUBLISHED_NODES: "node1"})
+			},
+			commands: []string{"zfs set k8s:published-nodes=node1 sharenfs=rw=@10.0.0.1/32 pool/csi/pvc-1"},
+		},
+		{
+			name:     "InheritProperty",
+			run:      func(z *ZfsClient) error { return z.InheritProperty("pool/csi/pvc-1", "compression") },
+			commands: []string{"zfs inherit compression pool/csi/pvc-1"},
+		},
+		{
+			name: "CreateSnapshot",
+			run: func(z *ZfsClient) error {
+				return z.CreateSnapshot("pool/csi/pvc-1@snap-1", map[string]string{ZFS_PROPERTY_SNAPSHOT: "citadel/snap-1"})
+			},
+			commands: []string{"zfs snapshot -o k8s:snapshot=citadel/snap-1 pool/csi/pvc-1@snap-1"},
+		},
+		{
+			name:     "DestroySnapshot",
+			run:      func(z *ZfsClient) error { return z.DestroySnapshot("pool/csi/pvc-1@snap-1") },
+			commands: []string{"zfs destroy pool/csi/pvc-1@snap-1"},
+		},
+		{
+			name:     "DestroyDataset",
+			run:      func(z *ZfsClient) error { return z.DestroyDataset("pool/csi/pvc-1") },
+			commands: []string{"zfs destroy -r pool/csi/pvc-1"},
+		},
+		{
+			name:    "ListSnapshots",
+			outputs: map[string]string{"zfs list -H -p -r -t snapshot -o name,creation,referenced,k8s:snapshot pool/csi": "pool/csi/pvc-1@snap-1\t1700000000\t1024\tcitadel/snap-1"},
+			run: func(z *ZfsClient) error {
+				_, err := z.ListSnapshots([]string{"pool/csi"}, []string{ZFS_PROPERTY_SNAPSHOT})
+				return err
+			},
+			commands: []string{"zfs list -H -p -r -t snapshot -o name,creation,referenced,k8s:snapshot pool/csi"},
+		},
+		{
+			name: "ListSnapshots nested parents",
+			run: func(z *ZfsClient) error {
+				_, err := z.ListSnapshots([]string{"pool/csi/fast", "pool/csi", "tank/csi", "pool/csi"}, []string{})
+				return err
+			},
+			commands: []string{"zfs list -H -p -r -t snapshot -o name,creation,referenced pool/csi tank/csi"},
+		},
+		{
+			name: "CloneSnapshot",
+			run: func(z *ZfsClient) error {
+				return z.CloneSnapshot("pool/csi/pvc-1@snap-1", "pool/csi/pvc-2", map[string]string{ZFS_PROPERTY_PVC: "data", ZFS_PROPERTY_NAMESPACE: "default"})
+			},
+			commands: []string{"zfs clone -o k8s:namespace=default -o k8s:pvc=data pool/csi/pvc-1@snap-1 pool/csi/pvc-2"},
+		},
+		{
+			name:     "PromoteDataset",
+			run:      func(z *ZfsClient) error { return z.PromoteDataset("pool/csi/pvc-2") },
+			commands: []string{"zfs promote pool/csi/pvc-2"},
+		},
+		{
+			name: "CopySnapshot",
+			sudo: true,
+			run: func(z *ZfsClient) error {
+				return z.CopySnapshot("pool/csi/pvc-1@snap-1", "pool/archive/pvc-1", map[string]string{ZFS_PROPERTY_PVC: "my data"})
+			},
+			outputs: map[string]string{
+				"sudo zfs get -H -p -o property,value encryptionroot pool/csi/pvc-1@snap-1": "encryptionroot\t-\n",
+			},
+			commands: []string{
+				"sudo zfs get -H -p -o property,value encryptionroot pool/csi/pvc-1@snap-1",
+				`{ sudo zfs send pool/csi/pvc-1@snap-1 || echo "pipeline stage failed: 1 $?" >&2; } | sudo zfs recv -o 'k8s:pvc=my data' pool/archive/pvc-1`,
+			},
+		},
+		{
+			name: "CopySnapshot encrypted",
+			run: func(z *ZfsClient) error {
+				return z.CopySnapshot("pool/csi/pvc-1@snap-1", "pool/archive/pvc-1", map[string]string{ZFS_PROPERTY_READONLY: ZFS_PROPERTY_ON})
+			},
+			outputs: map[string]string{
+				"zfs get -H -p -o property,value encryptionroot pool/csi/pvc-1@snap-1": "encryptionroot\tpool/csi/pvc-1\n",
+			},
+			commands: []string{
+				"zfs get -H -p -o property,value encryptionroot pool/csi/pvc-1@snap-1",
+				`{ zfs send -w pool/csi/pvc-1@snap-1 || echo "pipeline stage failed: 1 $?" >&2; } | zfs recv -o readonly=on pool/archive/pvc-1`,
+			},
+		},
+	})
+}